@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// A destructive command that waits for a second admin, it holds the operation lock meanwhile
+type approval_t struct {
+	Id        string
+	Summary   string // what the command will do, e.g. "delete 4 roles and their channels from batch 2"
+	Requested time.Time
+	op        *operation_t
+	run       func()
+	messageID string
+	self      bool // no second admin is configured, the requester confirms it (REQUIRE_SECOND_APPROVER is false)
+}
+
+var approvals = map[string]*approval_t{} // [id]approval
+var approvalMutex sync.Mutex
+var approvalCounter int
+
+// Run the command of op right away, or ask a second admin to approve it first if REQUIRES_APPROVAL says so
+// Returns true if the approval took over op, it's released once the command ran or was rejected, cancelled or expired
+// Otherwise run has already returned (or never started because of the error) and the caller still owns op
+func request_approval(s *discordgo.Session, op *operation_t, summary string, run func()) (bool, error) {
+	if !REQUIRES_APPROVAL[op.Command] {
+		op.extend(RUNNING_LOCK_TTL)
+		run()
+		return false, nil
+	}
+	var approvers []string
+	for id, admin := range IS_AUTHORIZED_AS_ADMIN {
+		if admin && id != op.Owner {
+			approvers = append(approvers, "<@"+id+">")
+		}
+	}
+	self := len(approvers) == 0
+	if self && REQUIRE_SECOND_APPROVER {
+		return false, fmt.Errorf("%s needs the approval of a second admin, add one to IS_AUTHORIZED_AS_ADMIN first", op.Command)
+	}
+
+	approvalMutex.Lock()
+	approvalCounter++
+	a := &approval_t{Id: strconv.FormatInt(int64(approvalCounter), 36), Summary: summary, Requested: time.Now().UTC(), op: op, run: run, self: self}
+	approvals[a.Id] = a
+	approvalMutex.Unlock()
+
+	op.extend(APPROVAL_WINDOW)
+	message := fmt.Sprintf("%s+ %s NEEDS APPROVAL\n+ %s wants to %s\n+ another admin has %d minutes to approve it%s%s",
+		DIFF_MSG_START, op.Command, member_name(op.Owner), summary, int(APPROVAL_WINDOW.Minutes()), DIFF_MSG_END, strings.Join(approvers, " "))
+	if self {
+		message = fmt.Sprintf("%s+ %s NEEDS CONFIRMATION\n+ %s wants to %s\n+ no second admin is configured, confirm it within %d minutes%s<@%s>",
+			DIFF_MSG_START, op.Command, member_name(op.Owner), summary, int(APPROVAL_WINDOW.Minutes()), DIFF_MSG_END, op.Owner)
+	}
+	msg, err := s.ChannelMessageSendComplex(op.ChannelID, &discordgo.MessageSend{
+		Content: message,
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Approve", Style: discordgo.DangerButton, CustomID: component_id("approval", op.Owner, APPROVAL_WINDOW, a.Id, "approve")},
+			discordgo.Button{Label: "Reject", Style: discordgo.SecondaryButton, CustomID: component_id("approval", op.Owner, APPROVAL_WINDOW, a.Id, "reject")},
+		}}},
+	})
+	if err != nil {
+		take_approval(a.Id)
+		return false, err
+	}
+	a.messageID = msg.ID
+	append_audit_log(audit_entry_t{
+		Actor:   op.Owner,
+		Command: op.Command,
+		Action:  "approval_request",
+		Target:  summary,
+		Result:  "pending",
+	})
+
+	// /cancel and the expiry of the lock end the approval too
+	go func() {
+		<-op.ctx.Done()
+		if take_approval(a.Id) == nil {
+			return // decided
+		}
+		op.release() // nothing runs for an undecided request
+		outcome := "cancelled"
+		if time.Since(a.Requested) >= APPROVAL_WINDOW {
+			outcome = "expired"
+		}
+		append_audit_log(audit_entry_t{
+			Actor:   "starbot",
+			Command: op.Command,
+			Action:  "approval_" + outcome,
+			Target:  summary,
+			Before:  "requested by " + op.Owner,
+			Result:  outcome,
+		})
+		content := fmt.Sprintf("%s- %s %s WITHOUT APPROVAL\n- %s wanted to %s%s", DIFF_MSG_START, op.Command, strings.ToUpper(outcome), member_name(op.Owner), summary, DIFF_MSG_END)
+		_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:         a.messageID,
+			Channel:    op.ChannelID,
+			Content:    &content,
+			Components: []discordgo.MessageComponent{},
+		})
+		checkError(err)
+	}()
+	return true, nil
+}
+
+// Take the approval out of the queue, only the first decision counts, nil if it was decided already
+func take_approval(id string) *approval_t {
+	approvalMutex.Lock()
+	defer approvalMutex.Unlock()
+	a := approvals[id]
+	delete(approvals, id)
+	return a
+}
+
+// Approve or reject a destructive command
+// approval:<requester>:<expiry>:<approval id>:<approve|reject>, any admin but the requester may approve, the requester may withdraw
+// Without a second admin (and REQUIRE_SECOND_APPROVER false) the requester approves it themselves
+func handle_approval_component(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	state, err := parse_component_id(i.MessageComponentData().CustomID)
+	if err != nil || len(state.Args) != 2 {
+		return
+	}
+	user := interaction_user(i)
+	if user == nil || !IS_AUTHORIZED_AS_ADMIN[user.ID] {
+		respond_ephemeral(s, i, "Only admins can approve destructive commands")
+		return
+	}
+	approvalMutex.Lock()
+	pending, ok := approvals[state.Args[0]]
+	approvalMutex.Unlock()
+	if state.Args[1] == "approve" && user.ID == state.Invoker && !(ok && pending.self) {
+		respond_ephemeral(s, i, "You can't approve your own request, another admin has to")
+		return
+	}
+	a := take_approval(state.Args[0])
+	if a == nil {
+		respond_ephemeral(s, i, "This request is no longer pending")
+		return
+	}
+	op := a.op
+	if op.ctx.Err() != nil { // cancelled or expired just now, the watcher of request_approval reports it
+		op.release()
+		respond_ephemeral(s, i, "This request is no longer pending")
+		return
+	}
+
+	if state.Args[1] != "approve" {
+		action := "rejected"
+		if user.ID == op.Owner {
+			action = "withdrew"
+		}
+		append_audit_log(audit_entry_t{
+			Actor:   user.ID,
+			Command: op.Command,
+			Action:  "approval_rejected",
+			Target:  a.Summary,
+			Before:  "requested by " + op.Owner,
+			Result:  "ok",
+		})
+		respond_update(s, i, fmt.Sprintf("%s- %s REJECTED\n- %s %s the request of %s to %s%s", DIFF_MSG_START, op.Command, member_name(user.ID), action, member_name(op.Owner), a.Summary, DIFF_MSG_END))
+		op.release()
+		return
+	}
+
+	action := "approval_granted"
+	if a.self {
+		action = "approval_self"
+	}
+	append_audit_log(audit_entry_t{
+		Actor:   user.ID,
+		Command: op.Command,
+		Action:  action,
+		Target:  a.Summary,
+		Before:  "requested by " + op.Owner,
+		Result:  "ok",
+	})
+	respond_update(s, i, fmt.Sprintf("%s+ %s APPROVED\n+ %s approved the request of %s to %s%s", DIFF_MSG_START, op.Command, member_name(user.ID), member_name(op.Owner), a.Summary, DIFF_MSG_END))
+	op.extend(RUNNING_LOCK_TTL)
+	a.run()
+	op.release()
+}
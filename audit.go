@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// One line of the append-only audit log in ./data/audit.log
+type audit_entry_t struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`               // discord id of whoever caused the change, "starbot" for automatic changes
+	Command   string    `json:"command,omitempty"`   // command that caused the change, e.g. "/deleteroles"
+	Arguments string    `json:"arguments,omitempty"` // arguments of the command as typed
+	Action    string    `json:"action"`              // e.g. "sheet_write", "command" for the invocation itself
+	Target    string    `json:"target"`              // what was changed, e.g. "Player List!B12"
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+	Result    string    `json:"result"` // "ok" or the error message
+}
+
+// Commands whose invocation is recorded in the audit log
+var AUDITED_COMMANDS = map[string]bool{
+	"/scan_users":     true,
+	"/assignroles":    true,
+	"/webassignroles": true,
+	"/deleteroles":    true,
+	"/fetchplayers":   true,
+	"/uploadplayers":  true,
+	"/team":           true,
+	"/link":           true,
+	"/unlink":         true,
+	"/snapshot":       true,
+	"/cancel":         true,
+	"/audit":          true,
+	"/perm":           true,
+	"/myteam":         true,
+}
+
+// Actions that happen once per member in bulk commands, these are not mirrored to the mod-log channel
+var BULK_AUDIT_ACTIONS = map[string]bool{
+	"member_roles": true,
+}
+
+// How many entries /audit shows at most
+const AUDIT_QUERY_LIMIT int = 25
+
+var auditMutex sync.Mutex
+
+// Append an entry to the audit log (data folder must be present in directory)
+// and mirror it to the mod-log channel if one is configured
+func append_audit_log(entry audit_entry_t) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	checkError(err)
+
+	auditMutex.Lock()
+	f, err := os.OpenFile("./data/audit.log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		f.Close()
+	}
+	auditMutex.Unlock()
+	checkError(err)
+
+	if AUDIT_CHANNEL_ID != "" && botSession != nil && !BULK_AUDIT_ACTIONS[entry.Action] {
+		send_quiet_message(botSession, AUDIT_CHANNEL_ID, format_audit_entry(entry))
+	}
+}
+
+// Send a (long) message without notifying the members it mentions
+func send_quiet_message(s *discordgo.Session, channelID string, message string) {
+	for _, chunk := range split_message(message) {
+		_, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content:         chunk,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		checkError(err)
+	}
+}
+
+// "ok" or the error message, the Result of an entry
+func audit_result(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// Record that a privileged command was run, before it changes anything
+func audit_command_invocation(m *discordgo.MessageCreate) {
+	fields := strings.Fields(m.Content)
+	if len(fields) == 0 || !AUDITED_COMMANDS[fields[0]] {
+		return
+	}
+	append_audit_log(audit_entry_t{
+		Actor:     m.Author.ID,
+		Command:   fields[0],
+		Arguments: strings.TrimSpace(strings.TrimPrefix(m.Content, fields[0])),
+		Action:    "command",
+		Target:    "channel " + m.ChannelID,
+		Result:    "invoked",
+	})
+}
+
+// A single line for discord
+func format_audit_entry(e audit_entry_t) string {
+	actor := e.Actor
+	if _, err := strconv.ParseUint(actor, 10, 64); err == nil {
+		actor = "<@" + actor + ">"
+	}
+	line := fmt.Sprintf("`%s` %s", e.Time.Format("2006-01-02 15:04"), actor)
+	if e.Command != "" {
+		line += " " + e.Command
+	}
+	if e.Action == "command" {
+		if e.Arguments != "" {
+			line += " `" + e.Arguments + "`"
+		}
+		return line
+	}
+	line += " " + e.Action + " " + e.Target
+	if e.Before != "" || e.After != "" {
+		line += fmt.Sprintf(" (`%s` → `%s`)", e.Before, e.After)
+	}
+	if e.Result != "ok" {
+		line += " **" + e.Result + "**"
+	}
+	return line
+}
+
+// Filter of /audit, empty fields match everything
+type audit_query_t struct {
+	Actor   string
+	Command string
+	Since   time.Time
+}
+
+// Parse "[user] [command] [since]" in any order
+// since is a duration like 12h or 7d, or a date like 2022-03-01
+func parse_audit_query(args []string) (audit_query_t, error) {
+	var q audit_query_t
+	for _, arg := range args {
+		if id, ok := parse_member_argument(arg); ok {
+			q.Actor = id
+			continue
+		}
+		if strings.HasPrefix(arg, "/") {
+			q.Command = arg
+			continue
+		}
+		if t, err := time.Parse("2006-01-02", arg); err == nil {
+			q.Since = t
+			continue
+		}
+		if strings.HasSuffix(arg, "d") {
+			if days, err := strconv.Atoi(strings.TrimSuffix(arg, "d")); err == nil {
+				q.Since = time.Now().UTC().AddDate(0, 0, -days)
+				continue
+			}
+		}
+		if d, err := time.ParseDuration(arg); err == nil {
+			q.Since = time.Now().UTC().Add(-d)
+			continue
+		}
+		return q, fmt.Errorf("%s is not a member, command or time", arg)
+	}
+	return q, nil
+}
+
+// Returns the newest matching entries first, at most limit
+func query_audit_log(q audit_query_t, limit int) ([]audit_entry_t, error) {
+	f, err := os.Open("./data/audit.log")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var matches []audit_entry_t
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e audit_entry_t
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if (q.Actor != "" && e.Actor != q.Actor) || (q.Command != "" && e.Command != q.Command) || e.Time.Before(q.Since) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest first
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// /audit [user] [command] [since]
+func audit_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	q, err := parse_audit_query(strings.Fields(strings.TrimPrefix(m.Content, "/audit")))
+	if err == nil {
+		var entries []audit_entry_t
+		entries, err = query_audit_log(q, AUDIT_QUERY_LIMIT)
+		if err == nil {
+			message := fmt.Sprintf("**%d most recent audit entries**\n", len(entries))
+			if len(entries) == 0 {
+				message = "No audit entries match\n"
+			}
+			for _, e := range entries {
+				message += format_audit_entry(e) + "\n"
+			}
+			send_quiet_message(s, m.ChannelID, message)
+		}
+	}
+	record_command("/audit", command_outcome(err))
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /audit ERROR: "+err.Error()+"\nusage: /audit [@member] [/command] [12h|7d|2022-03-01]"+DIFF_MSG_END)
+		checkError(err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAuditQuery(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		args      []string
+		want      audit_query_t
+		wantSince time.Time // compared within a minute, zero for no time
+		wantErr   bool
+	}{
+		{"everything", nil, audit_query_t{}, time.Time{}, false},
+		{"member mention", []string{"<@123456789012345678>"}, audit_query_t{Actor: "123456789012345678"}, time.Time{}, false},
+		{"member id", []string{"123456789012345678"}, audit_query_t{Actor: "123456789012345678"}, time.Time{}, false},
+		{"command", []string{"/deleteroles"}, audit_query_t{Command: "/deleteroles"}, time.Time{}, false},
+		{"days", []string{"7d"}, audit_query_t{}, now.AddDate(0, 0, -7), false},
+		{"duration", []string{"12h"}, audit_query_t{}, now.Add(-12 * time.Hour), false},
+		{"date", []string{"2022-03-01"}, audit_query_t{}, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"any order", []string{"3d", "/perm", "<@!123456789012345678>"}, audit_query_t{Actor: "123456789012345678", Command: "/perm"}, now.AddDate(0, 0, -3), false},
+		{"unknown argument", []string{"yesterday"}, audit_query_t{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse_audit_query(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse_audit_query(%v) error = %v, want error %v", tt.args, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Actor != tt.want.Actor || got.Command != tt.want.Command {
+				t.Errorf("parse_audit_query(%v) = %+v, want %+v", tt.args, got, tt.want)
+			}
+			if diff := got.Since.Sub(tt.wantSince); diff < -time.Minute || diff > time.Minute {
+				t.Errorf("since = %s, want %s", got.Since, tt.wantSince)
+			}
+		})
+	}
+}
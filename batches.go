@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Roles and channels that were created together, so they can be rolled back with /deleteroles
+type role_batch_t struct {
+	Name           string
+	Created_by     string // discord id of the admin
+	Created_at     time.Time
+	Source         string // command that created the batch
+	Sheet_revision string // fingerprint of the sheet data the batch was built from, if any
+	Teams          []team_t
+}
+
+var mapRoleBatches = map[string]role_batch_t{} // [batchName]batch
+var roleBatchMutex sync.Mutex                  // /team create records batches without holding the operation lock
+
+// Start a new (not yet stored) batch
+func new_role_batch(source string, authorID string, sheetRevision string) role_batch_t {
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	return role_batch_t{
+		Name:           get_batch_name(mapRoleBatches),
+		Created_by:     authorID,
+		Created_at:     time.Now().UTC(),
+		Source:         source,
+		Sheet_revision: sheetRevision,
+	}
+}
+
+// Store a batch of created objects, returns the batch name
+// The batch gets the next free name if another batch was recorded under its name since new_role_batch
+func record_batch(batch role_batch_t) string {
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	if _, taken := mapRoleBatches[batch.Name]; taken {
+		batch.Name = get_batch_name(mapRoleBatches)
+	}
+	mapRoleBatches[batch.Name] = batch
+	store_data(mapRoleBatches, "mapRoleBatches")
+	return batch.Name
+}
+
+// Returns a copy of the batch, false if there is none by that name
+func get_role_batch(name string) (role_batch_t, bool) {
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	batch, ok := mapRoleBatches[name]
+	batch.Teams = append([]team_t(nil), batch.Teams...)
+	return batch, ok
+}
+
+func count_role_batches() int {
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	return len(mapRoleBatches)
+}
+
+// Replace the entries of a batch, the batch is dropped once it has none left
+func set_role_batch_teams(name string, teams []team_t) {
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	batch, ok := mapRoleBatches[name]
+	if !ok {
+		return
+	}
+	if len(teams) == 0 {
+		delete(mapRoleBatches, name)
+	} else {
+		batch.Teams = teams
+		mapRoleBatches[name] = batch
+	}
+	store_data(mapRoleBatches, "mapRoleBatches")
+}
+
+// Move batches stored by older versions (only role ids and names) into mapRoleBatches
+func migrate_legacy_batches() {
+	if _, err := os.Stat("./data/mapBatchesOfCreatedRoles"); err != nil {
+		return
+	}
+	var legacy map[string][]team_t
+	load_data(&legacy, "mapBatchesOfCreatedRoles")
+	for name, teams := range legacy {
+		if _, exists := mapRoleBatches[name]; exists {
+			name = get_batch_name(mapRoleBatches)
+		}
+		mapRoleBatches[name] = role_batch_t{
+			Name:   name,
+			Source: "legacy",
+			Teams:  teams,
+		}
+	}
+	store_data(mapRoleBatches, "mapRoleBatches")
+	err := os.Rename("./data/mapBatchesOfCreatedRoles", "./data/mapBatchesOfCreatedRoles.migrated")
+	checkError(err)
+}
+
+// Short fingerprint of the sheet ranges a batch was built from
+func sheet_revision(ranges ...*sheets.ValueRange) string {
+	h := sha256.New()
+	for _, r := range ranges {
+		if r == nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s\n%v\n", r.Range, r.Values)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Returns true if discord says the role or channel doesn't exist (anymore)
+func is_not_found(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+	if restErr.Message != nil && (restErr.Message.Code == discordgo.ErrCodeUnknownRole || restErr.Message.Code == discordgo.ErrCodeUnknownChannel) {
+		return true
+	}
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// Compare a batch with the live guild: roles deleted by hand are marked, channels deleted by hand are forgotten
+func refresh_role_batch(s *discordgo.Session, name string) (role_batch_t, error) {
+	batch, ok := get_role_batch(name)
+	if !ok {
+		return batch, fmt.Errorf("no batch %s", name)
+	}
+	roles, err := s.GuildRoles(DISCORD_SERVER_ID)
+	if err != nil {
+		return batch, err
+	}
+	channels, err := s.GuildChannels(DISCORD_SERVER_ID)
+	if err != nil {
+		return batch, err
+	}
+	roleExists := make(map[string]bool)
+	for _, r := range roles {
+		roleExists[r.ID] = true
+	}
+	channelExists := make(map[string]bool)
+	for _, c := range channels {
+		channelExists[c.ID] = true
+	}
+
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	batch, ok = mapRoleBatches[name]
+	if !ok { // deleted while the guild was loading
+		return batch, fmt.Errorf("no batch %s", name)
+	}
+	batch.Teams = append([]team_t(nil), batch.Teams...)
+	for i, t := range batch.Teams {
+		t.Exists = roleExists[t.Discord_id]
+		for _, id := range []*string{&t.Category_id, &t.Text_channel_id, &t.Voice_channel_id} {
+			if *id != "" && !channelExists[*id] {
+				*id = ""
+			}
+		}
+		batch.Teams[i] = t
+	}
+	mapRoleBatches[name] = batch
+	store_data(mapRoleBatches, "mapRoleBatches")
+	batch.Teams = append([]team_t(nil), batch.Teams...)
+	return batch, nil
+}
+
+// Returns the batch names sorted by number
+func sorted_batch_names() []string {
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	var names []string
+	for n := range mapRoleBatches {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(names[i])
+		b, errB := strconv.Atoi(names[j])
+		if errA != nil || errB != nil {
+			return names[i] < names[j]
+		}
+		return a < b
+	})
+	return names
+}
+
+// Human readable overview of a batch, entries are numbered for partial deletion
+func render_role_batch(batch role_batch_t) string {
+	createdBy := "unknown"
+	if batch.Created_by != "" {
+		createdBy = "<@" + batch.Created_by + ">"
+	}
+	created := "unknown date"
+	if !batch.Created_at.IsZero() {
+		created = batch.Created_at.Format("2006-01-02 15:04 MST")
+	}
+	message := fmt.Sprintf("**Batch %s** - %s by %s, %s", batch.Name, batch.Source, createdBy, created)
+	if batch.Sheet_revision != "" {
+		message += ", sheet revision `" + batch.Sheet_revision + "`"
+	}
+	message += "\n"
+	for i, t := range batch.Teams {
+		var channels int
+		for _, id := range []string{t.Category_id, t.Text_channel_id, t.Voice_channel_id} {
+			if id != "" {
+				channels++
+			}
+		}
+		switch {
+		case t.Channels_only:
+			message += fmt.Sprintf("\t%d. %d channels of %s\n", i+1, channels, t.Name)
+		case t.Exists:
+			message += fmt.Sprintf("\t%d. <@&%s> %s, %d channels\n", i+1, t.Discord_id, t.Name, channels)
+		default:
+			message += fmt.Sprintf("\t%d. ~~%s~~ role already removed, %d channels\n", i+1, t.Name, channels)
+		}
+	}
+	return message
+}
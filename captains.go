@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// An assistant coach appointed by the captain or coach of their team with /myteam assistant add
+// Role syncs keep the role as long as the player stays on that team, even though the WebApp doesn't list them
+type assistant_coach_t struct {
+	Team_role_id string
+	Added_by     string
+	Added_at     time.Time
+}
+
+var mapAssistantCoaches = map[int]assistant_coach_t{} // [WebUserId]appointment
+
+const MYTEAM_COMMAND_USAGE string = `/myteam roster
+/myteam assistant add @member
+/myteam assistant remove @member
+/myteam announce <message>
+start with "<team>" if you lead more than one team, e.g. /myteam "Team 1" roster`
+
+// The active teams a member is captain or coach of
+// Captains and coaches are set with /team captain|coach, coaches of the WebApp (or with the coach role) lead the team they play on
+func led_teams(userID string, roles []string) []registered_team_t {
+	led := make(map[string]registered_team_t)
+	for _, t := range active_teams() {
+		if t.Captain_id == userID || t.Coach_id == userID {
+			led[t.Role_id] = t
+		}
+	}
+	if webId, found := get_web_id_by_discord_id(userID); found {
+		player, _ := get_web_player(webId)
+		coach := false
+		for _, helper := range player.Helper_role {
+			coach = coach || helper == WEB_HELPER_COACH
+		}
+		for _, r := range roles {
+			coach = coach || r == COACH_ROLE_ID
+		}
+		if team, ok := resolve_team(player.Team); ok && coach {
+			led[team.Role_id] = team
+		}
+	}
+
+	var teams []registered_team_t
+	for _, t := range led {
+		teams = append(teams, t)
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams
+}
+
+// The players of the roster that are on a team, previous names of the team count too
+func team_players(team registered_team_t) []web_player_t {
+	var players []web_player_t
+	for _, p := range all_web_players() {
+		if t, ok := resolve_team(p.Team); ok && t.Role_id == team.Role_id {
+			players = append(players, p)
+		}
+	}
+	sort.Slice(players, func(i, j int) bool { return strings.ToLower(players[i].WebName) < strings.ToLower(players[j].WebName) })
+	return players
+}
+
+// Whether an appointment with /myteam assistant add still applies to the player
+func is_appointed_assistant_coach(player web_player_t) bool {
+	a, ok := mapAssistantCoaches[player.WebUserId]
+	if !ok {
+		return false
+	}
+	team, found := resolve_team(player.Team)
+	return found && team.Role_id == a.Team_role_id
+}
+
+// /myteam ["<team>"] roster|assistant|announce
+func myteam_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	args := split_arguments(strings.TrimPrefix(m.Content, "/myteam"))
+	var roles []string
+	if member, err := get_guild_member(s, m.Author.ID); err == nil {
+		roles = member.Roles
+	}
+	teams := led_teams(m.Author.ID, roles)
+
+	var team registered_team_t
+	var err error
+	teamGiven := false
+	switch {
+	case len(teams) == 0:
+		err = fmt.Errorf("you are not the captain or coach of an active team")
+	case len(args) > 0 && !is_myteam_subcommand(args[0]):
+		err = fmt.Errorf("you don't lead a team named %s", args[0])
+		if named, ok := resolve_team(args[0]); ok {
+			for _, t := range teams {
+				if t.Role_id == named.Role_id {
+					team, err = t, nil
+				}
+			}
+		}
+		args = args[1:]
+		teamGiven = true
+	case len(teams) > 1:
+		var names []string
+		for _, t := range teams {
+			names = append(names, t.Name)
+		}
+		err = fmt.Errorf("you lead %s, start with the team, e.g. /myteam \"%s\" roster", strings.Join(names, ", "), teams[0].Name)
+	default:
+		team = teams[0]
+	}
+
+	var reply string
+	if err == nil {
+		switch {
+		case len(args) == 1 && args[0] == "roster":
+			send_long_message(s, m.ChannelID, team_roster_message(team))
+		case len(args) == 3 && args[0] == "assistant" && (args[1] == "add" || args[1] == "remove"):
+			reply, err = set_assistant_coach(s, team, m.Author.ID, args[2], args[1] == "add")
+		case len(args) > 1 && args[0] == "announce":
+			reply, err = post_team_announcement(s, team, m.Author.ID, announcement_text(m.Content, teamGiven))
+		default:
+			err = fmt.Errorf("usage:\n%s", MYTEAM_COMMAND_USAGE)
+		}
+	}
+
+	record_command("/myteam", command_outcome(err))
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /myteam ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	if reply != "" {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+reply+DIFF_MSG_END)
+		checkError(err)
+	}
+}
+
+func is_myteam_subcommand(arg string) bool {
+	return arg == "roster" || arg == "assistant" || arg == "announce"
+}
+
+// The players of a team with their tier, race and availability
+func team_roster_message(team registered_team_t) string {
+	players := team_players(team)
+	message := fmt.Sprintf("**%s roster (%d players)**\n", team.Name, len(players))
+	for _, p := range players {
+		var notes []string
+		for _, helper := range p.Helper_role {
+			if helper == WEB_HELPER_COACH || helper == WEB_HELPER_ASSISTANT_COACH {
+				notes = append(notes, WEB_HELPER_ROLE_NAMES[helper])
+			}
+		}
+		if is_appointed_assistant_coach(p) {
+			notes = append(notes, "appointed Assistant Coach")
+		}
+		switch {
+		case p.Discord_id == "":
+			notes = append(notes, "not linked")
+		case p.Left_server:
+			notes = append(notes, "left the server")
+		}
+		availability := "unknown"
+		if len(p.Availability) > 0 {
+			var slots []string
+			for _, a := range p.Availability {
+				slots = append(slots, strconv.Itoa(a))
+			}
+			availability = strings.Join(slots, ",")
+		}
+		line := fmt.Sprintf("`%s` %s, %s, availability %s", p.WebName, tier_name(p.Tier), race_name(p.Race), availability)
+		if len(notes) > 0 {
+			line += " (" + strings.Join(notes, ", ") + ")"
+		}
+		message += line + "\n"
+	}
+	if len(players) == 0 {
+		message += "No players on the roster are on this team\n"
+	}
+	return message
+}
+
+// Give (add) or take the assistant coach role of a member of the team
+func set_assistant_coach(s *discordgo.Session, team registered_team_t, leaderID string, target string, add bool) (string, error) {
+	discordId, ok := parse_member_argument(target)
+	if !ok {
+		return "", fmt.Errorf("%s is not a member mention or id", target)
+	}
+	webId, found := get_web_id_by_discord_id(discordId)
+	if !found {
+		return "", fmt.Errorf("%s is not linked to a player of the roster", member_name(discordId))
+	}
+	player, _ := get_web_player(webId)
+	if t, ok := resolve_team(player.Team); !ok || t.Role_id != team.Role_id {
+		return "", fmt.Errorf("%s is not on %s", player.WebName, team.Name)
+	}
+	if player.Left_server {
+		return "", fmt.Errorf("%s left the server", player.WebName)
+	}
+
+	action := "assistant_coach_add"
+	if add {
+		mapAssistantCoaches[webId] = assistant_coach_t{Team_role_id: team.Role_id, Added_by: leaderID, Added_at: time.Now().UTC()}
+	} else {
+		for _, helper := range player.Helper_role {
+			if helper == WEB_HELPER_ASSISTANT_COACH {
+				return "", fmt.Errorf("the WebApp lists %s as assistant coach, ask an admin to change it there", player.WebName)
+			}
+		}
+		if _, appointed := mapAssistantCoaches[webId]; !appointed {
+			return "", fmt.Errorf("%s is not an assistant coach of %s", player.WebName, team.Name)
+		}
+		delete(mapAssistantCoaches, webId)
+		action = "assistant_coach_remove"
+	}
+	storeErr := store_data(mapAssistantCoaches, "mapAssistantCoaches")
+
+	changes, err := apply_member_roles(s, discordId, map[string]bool{ASST_COACH_ROLE_ID: add})
+	if err == nil && storeErr != nil {
+		err = fmt.Errorf("could not store the change, it only lasts until the bot restarts: %w", storeErr)
+	}
+	append_audit_log(audit_entry_t{
+		Actor:   leaderID,
+		Command: "/myteam",
+		Action:  action,
+		Target:  fmt.Sprintf("%s (%s) of %s", player.WebName, discordId, team.Name),
+		After:   strings.Join(changes, " "),
+		Result:  audit_result(err),
+	})
+	if err != nil {
+		return "", err
+	}
+	if add {
+		return fmt.Sprintf("+ %s is now an assistant coach of %s", player.WebName, team.Name), nil
+	}
+	return fmt.Sprintf("+ %s is no longer an assistant coach of %s", player.WebName, team.Name), nil
+}
+
+// The message of /myteam [<team>] announce <message>, with its line breaks and spacing
+// The team is skipped first, so a team with "announce" in its name doesn't cut the message short
+func announcement_text(content string, teamGiven bool) string {
+	rest := strings.TrimSpace(strings.TrimPrefix(content, "/myteam"))
+	if teamGiven {
+		if strings.HasPrefix(rest, "\"") {
+			if parts := strings.SplitN(rest[1:], "\"", 2); len(parts) == 2 {
+				rest = parts[1]
+			}
+		} else if parts := strings.SplitN(rest, " ", 2); len(parts) == 2 {
+			rest = parts[1]
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	if fields := strings.Fields(rest); len(fields) == 0 || fields[0] != "announce" {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(rest, "announce"))
+}
+
+// Post a message in the text channel of the team that pings the team role, and nobody else
+func post_team_announcement(s *discordgo.Session, team registered_team_t, leaderID string, text string) (string, error) {
+	if text == "" {
+		return "", fmt.Errorf("usage:\n%s", MYTEAM_COMMAND_USAGE)
+	}
+	if team.Text_channel_id == "" {
+		return "", fmt.Errorf("%s has no text channel, ask an admin to /team provision it", team.Name)
+	}
+	_, err := s.ChannelMessageSendComplex(team.Text_channel_id, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("📢 <@&%s> announcement from <@%s>:\n%s", team.Role_id, leaderID, text),
+		AllowedMentions: &discordgo.MessageAllowedMentions{Roles: []string{team.Role_id}},
+	})
+	append_audit_log(audit_entry_t{
+		Actor:   leaderID,
+		Command: "/myteam",
+		Action:  "team_announcement",
+		Target:  team.Name + " (channel " + team.Text_channel_id + ")",
+		After:   text,
+		Result:  audit_result(err),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "+ Posted the announcement in the channel of " + team.Name, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+)
+
+var testTeams = []registered_team_t{
+	{Name: "Team 1", Role_id: "1001"},
+	{Name: "Team 2", Role_id: "1002", Aliases: []string{"Old Team 2"}},
+	{Name: "Team 3", Role_id: "1003", Archived: true},
+}
+
+func TestIsAppointedAssistantCoach(t *testing.T) {
+	use_test_teams(t, testTeams...)
+	use_test_assistants(t, map[int]assistant_coach_t{
+		1: {Team_role_id: "1001"},
+		2: {Team_role_id: "1002"},
+		3: {Team_role_id: "1003"},
+	})
+
+	tests := []struct {
+		name   string
+		player web_player_t
+		want   bool
+	}{
+		{"appointed for their team", web_player_t{WebUserId: 1, Team: "Team 1"}, true},
+		{"team found by a previous name", web_player_t{WebUserId: 2, Team: "Old Team 2"}, true},
+		{"moved to another team", web_player_t{WebUserId: 1, Team: "Team 2"}, false},
+		{"left their team", web_player_t{WebUserId: 1}, false},
+		{"team was archived", web_player_t{WebUserId: 3, Team: "Team 3"}, false},
+		{"never appointed", web_player_t{WebUserId: 4, Team: "Team 1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := is_appointed_assistant_coach(tt.player); got != tt.want {
+				t.Errorf("is_appointed_assistant_coach() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDesiredPlayerRolesAssistantCoach(t *testing.T) {
+	use_test_teams(t, testTeams...)
+	use_test_assistants(t, map[int]assistant_coach_t{1: {Team_role_id: "1001"}})
+
+	tests := []struct {
+		name       string
+		player     web_player_t
+		wantAssist bool
+		wantCoach  bool
+		wantTeam   string // role id of the team role that is given, the other active team roles are taken
+	}{
+		{"appointed assistant coach", web_player_t{WebUserId: 1, Team: "Team 1"}, true, false, "1001"},
+		{"appointment ends when moving team", web_player_t{WebUserId: 1, Team: "Team 2"}, false, false, "1002"},
+		{"assistant coach in the WebApp", web_player_t{WebUserId: 2, Team: "Team 2", Helper_role: []int{WEB_HELPER_ASSISTANT_COACH}}, true, false, "1002"},
+		{"coach in the WebApp", web_player_t{WebUserId: 3, Team: "Team 1", Helper_role: []int{WEB_HELPER_COACH}}, false, true, "1001"},
+		{"player", web_player_t{WebUserId: 4, Team: "Team 2"}, false, false, "1002"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desired := desired_player_roles(tt.player)
+			assist, managed := desired[ASST_COACH_ROLE_ID]
+			if !managed || assist != tt.wantAssist {
+				t.Errorf("assistant coach role = %v (managed %v), want %v", assist, managed, tt.wantAssist)
+			}
+			if desired[COACH_ROLE_ID] != tt.wantCoach {
+				t.Errorf("coach role = %v, want %v", desired[COACH_ROLE_ID], tt.wantCoach)
+			}
+			for _, team := range active_teams() {
+				if want := team.Role_id == tt.wantTeam; desired[team.Role_id] != want {
+					t.Errorf("role of %s = %v, want %v", team.Name, desired[team.Role_id], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLedTeams(t *testing.T) {
+	use_test_teams(t,
+		registered_team_t{Name: "Team 1", Role_id: "1001", Captain_id: "500"},
+		registered_team_t{Name: "Team 2", Role_id: "1002", Coach_id: "500"},
+		registered_team_t{Name: "Team 3", Role_id: "1003", Captain_id: "500", Archived: true},
+	)
+	use_test_roster(t,
+		web_player_t{WebUserId: 1, WebName: "Coach", Team: "Team 1", Discord_id: "501", Helper_role: []int{WEB_HELPER_COACH}},
+		web_player_t{WebUserId: 2, WebName: "Player", Team: "Team 2", Discord_id: "502"},
+	)
+
+	tests := []struct {
+		name   string
+		userID string
+		roles  []string
+		want   []string
+	}{
+		{"captain and coach set with /team", "500", nil, []string{"Team 1", "Team 2"}},
+		{"coach in the WebApp", "501", nil, []string{"Team 1"}},
+		{"coach role on the server", "502", []string{COACH_ROLE_ID}, []string{"Team 2"}},
+		{"player", "502", nil, nil},
+		{"not on the roster", "503", []string{COACH_ROLE_ID}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := led_teams(tt.userID, tt.roles)
+			if len(got) != len(tt.want) {
+				t.Fatalf("led_teams() = %+v, want %v", got, tt.want)
+			}
+			for i, team := range got {
+				if team.Name != tt.want[i] {
+					t.Errorf("team %d = %s, want %s", i, team.Name, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAnnouncementText(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		teamGiven bool
+		want      string
+	}{
+		{"message", "/myteam announce practice at 8", false, "practice at 8"},
+		{"line breaks are kept", "/myteam announce practice\n  at 8", false, "practice\n  at 8"},
+		{"team", "/myteam Team1 announce practice", true, "practice"},
+		{"quoted team", "/myteam \"Team 1\" announce practice", true, "practice"},
+		{"team named like the subcommand", "/myteam \"announce team\" announce practice", true, "practice"},
+		{"subcommand in the message", "/myteam announce announce the roster", false, "announce the roster"},
+		{"no message", "/myteam announce", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := announcement_text(tt.content, tt.teamGiven); got != tt.want {
+				t.Errorf("announcement_text(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// What team members (and staff) may do in their private channels
+const TEAM_CHANNEL_ALLOW int64 = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages |
+	discordgo.PermissionReadMessageHistory | discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak
+
+// What is taken away from team members when the channels are archived
+const ARCHIVED_CHANNEL_DENY int64 = discordgo.PermissionSendMessages | discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak
+
+var channelNameRegex = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// Discord text channel names are lowercase without spaces
+func text_channel_name(teamName string) string {
+	return strings.Trim(channelNameRegex.ReplaceAllString(strings.ToLower(strings.ReplaceAll(teamName, " ", "-")), ""), "-")
+}
+
+// Only the team role and staff can see the channels of a team
+func team_channel_overwrites(teamRoleID string, allow int64, deny int64) []*discordgo.PermissionOverwrite {
+	overwrites := []*discordgo.PermissionOverwrite{
+		{ID: DISCORD_SERVER_ID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel}, // @everyone
+		{ID: teamRoleID, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny},
+	}
+	if STAFF_ROLE_ID != "" {
+		overwrites = append(overwrites, &discordgo.PermissionOverwrite{ID: STAFF_ROLE_ID, Type: discordgo.PermissionOverwriteTypeRole, Allow: TEAM_CHANNEL_ALLOW})
+	}
+	return overwrites
+}
+
+// Team channels are private, without STAFF_ROLE_ID nobody but the team could see them
+func check_staff_role() error {
+	if STAFF_ROLE_ID == "" {
+		return fmt.Errorf("STAFF_ROLE_ID is not configured, staff couldn't see the team channels")
+	}
+	return nil
+}
+
+// Create a category with a private text and voice channel for a team
+// Everything that was created is recorded on the team, even if a later step fails
+func provision_team_channels(s *discordgo.Session, team *registered_team_t) error {
+	if team.Category_id != "" {
+		return fmt.Errorf("%s already has channels", team.Name)
+	}
+	if err := check_staff_role(); err != nil {
+		return err
+	}
+	overwrites := team_channel_overwrites(team.Role_id, TEAM_CHANNEL_ALLOW, 0)
+
+	category, err := s.GuildChannelCreateComplex(DISCORD_SERVER_ID, discordgo.GuildChannelCreateData{
+		Name:                 team.Name,
+		Type:                 discordgo.ChannelTypeGuildCategory,
+		PermissionOverwrites: overwrites,
+	})
+	if err != nil {
+		return err
+	}
+	team.Category_id = category.ID
+
+	text, err := s.GuildChannelCreateComplex(DISCORD_SERVER_ID, discordgo.GuildChannelCreateData{
+		Name:                 text_channel_name(team.Name),
+		Type:                 discordgo.ChannelTypeGuildText,
+		Topic:                "Private channel of " + team.Name,
+		ParentID:             category.ID,
+		PermissionOverwrites: overwrites,
+	})
+	if err != nil {
+		return err
+	}
+	team.Text_channel_id = text.ID
+
+	voice, err := s.GuildChannelCreateComplex(DISCORD_SERVER_ID, discordgo.GuildChannelCreateData{
+		Name:                 team.Name,
+		Type:                 discordgo.ChannelTypeGuildVoice,
+		ParentID:             category.ID,
+		PermissionOverwrites: overwrites,
+	})
+	if err != nil {
+		return err
+	}
+	team.Voice_channel_id = voice.ID
+	return nil
+}
+
+// Edit a channel without moving it (discordgo always sends the position)
+func edit_channel(s *discordgo.Session, channelID string, change func(edit *discordgo.ChannelEdit)) error {
+	if channelID == "" {
+		return nil
+	}
+	channel, err := s.Channel(channelID)
+	if err != nil {
+		return err
+	}
+	edit := &discordgo.ChannelEdit{Position: channel.Position}
+	change(edit)
+	_, err = s.ChannelEditComplex(channelID, edit)
+	return err
+}
+
+// Rename the channels of a team after the team was renamed
+func rename_team_channels(s *discordgo.Session, team registered_team_t) error {
+	err := edit_channel(s, team.Category_id, func(e *discordgo.ChannelEdit) { e.Name = team.Name })
+	if err != nil {
+		return err
+	}
+	err = edit_channel(s, team.Text_channel_id, func(e *discordgo.ChannelEdit) { e.Name = text_channel_name(team.Name) })
+	if err != nil {
+		return err
+	}
+	return edit_channel(s, team.Voice_channel_id, func(e *discordgo.ChannelEdit) { e.Name = team.Name })
+}
+
+// Make the channels of a team read-only and move them into the archive category of their season
+func archive_team_channels(s *discordgo.Session, team *registered_team_t) error {
+	if team.Category_id == "" {
+		return nil // team never had channels
+	}
+	archive, err := get_archive_category(s, team.Season)
+	if err != nil {
+		return err
+	}
+	overwrites := team_channel_overwrites(team.Role_id, discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory, ARCHIVED_CHANNEL_DENY)
+	for _, channelID := range []string{team.Text_channel_id, team.Voice_channel_id} {
+		err = edit_channel(s, channelID, func(e *discordgo.ChannelEdit) {
+			e.ParentID = archive.ID
+			e.PermissionOverwrites = overwrites
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the team category is empty now
+	_, err = s.ChannelDelete(team.Category_id)
+	if err != nil {
+		return err
+	}
+	team.Category_id = ""
+	return nil
+}
+
+// Returns the category that holds the archived team channels of a season, creates it if needed
+func get_archive_category(s *discordgo.Session, season int) (*discordgo.Channel, error) {
+	name := fmt.Sprintf("Archive Season %d", season)
+	channels, err := s.GuildChannels(DISCORD_SERVER_ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range channels {
+		if c.Type == discordgo.ChannelTypeGuildCategory && c.Name == name {
+			return c, nil
+		}
+	}
+	overwrites := []*discordgo.PermissionOverwrite{
+		{ID: DISCORD_SERVER_ID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
+	}
+	return s.GuildChannelCreateComplex(DISCORD_SERVER_ID, discordgo.GuildChannelCreateData{
+		Name:                 name,
+		Type:                 discordgo.ChannelTypeGuildCategory,
+		PermissionOverwrites: overwrites,
+	})
+}
+
+// Delete every channel that was created for a team (used when rolling back a batch)
+// Channels that are already gone are not an error, the returned entry only holds the channels that are left
+func delete_team_channels(s *discordgo.Session, t team_t) (team_t, []error) {
+	var errs []error
+	for _, channelID := range []*string{&t.Text_channel_id, &t.Voice_channel_id, &t.Category_id} {
+		if *channelID == "" {
+			continue
+		}
+		_, err := s.ChannelDelete(*channelID)
+		if err != nil && !is_not_found(err) { // deleted by hand
+			errs = append(errs, err)
+			continue
+		}
+		*channelID = ""
+	}
+	return t, errs
+}
+
+// Provision the channels of a team and remember them in the registry, even if only some could be created
+func provision_team(s *discordgo.Session, team *registered_team_t) error {
+	err := provision_team_channels(s, team)
+	register_team(*team)
+	return err
+}
+
+// Forget the channels of a team after they were deleted with their batch
+func forget_team_channels(roleID string) {
+	if team, ok := get_registered_team(roleID); ok {
+		team.Category_id = ""
+		team.Text_channel_id = ""
+		team.Voice_channel_id = ""
+		register_team(team)
+	}
+}
+
+// The batch entry that lets /deleteroles roll back what was created for a team
+func batch_entry(team registered_team_t, channelsOnly bool) team_t {
+	return team_t{
+		Name:             team.Name,
+		Discord_id:       team.Role_id,
+		Color:            team.Color,
+		Exists:           true,
+		Category_id:      team.Category_id,
+		Text_channel_id:  team.Text_channel_id,
+		Voice_channel_id: team.Voice_channel_id,
+		Channels_only:    channelsOnly,
+	}
+}
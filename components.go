@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// How long buttons and select menus stay usable
+const COMPONENT_TTL time.Duration = 15 * time.Minute
+
+// State carried by the custom id of a button or select menu, so answering it needs no memory of the prompt
+// <feature>:<invoker>:<expiry>:<args...>, discord allows 100 characters, which leaves about 60 for the args
+type component_state_t struct {
+	Feature string
+	Invoker string // only this user may answer
+	Expires time.Time
+	Args    []string
+}
+
+// Custom id of a component that only invoker can use until ttl has passed
+func component_id(feature string, invoker string, ttl time.Duration, args ...string) string {
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 36)
+	return strings.Join(append([]string{feature, invoker, expires}, args...), ":")
+}
+
+func parse_component_id(customID string) (component_state_t, error) {
+	parts := strings.Split(customID, ":")
+	if len(parts) < 3 {
+		return component_state_t{}, fmt.Errorf("malformed custom id %s", customID)
+	}
+	expires, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil {
+		return component_state_t{}, fmt.Errorf("malformed custom id %s", customID)
+	}
+	return component_state_t{
+		Feature: parts[0],
+		Invoker: parts[1],
+		Expires: time.Unix(expires, 0),
+		Args:    parts[3:],
+	}, nil
+}
+
+// Returns the state of the clicked component if the user who clicked may use it
+// Answers everybody else, and takes expired components off their message
+func authorize_component(s *discordgo.Session, i *discordgo.InteractionCreate) (component_state_t, bool) {
+	state, err := parse_component_id(i.MessageComponentData().CustomID)
+	if err != nil {
+		checkError(err)
+		respond_ephemeral(s, i, "This prompt is broken, run the command again")
+		return state, false
+	}
+	if time.Now().After(state.Expires) {
+		respond_ephemeral(s, i, "This prompt has expired, run the command again")
+		if i.Message != nil {
+			_, err = s.ChannelMessageEditComplex(&discordgo.MessageEdit{ID: i.Message.ID, Channel: i.ChannelID, Components: []discordgo.MessageComponent{}})
+			checkError(err)
+		}
+		return state, false
+	}
+	user := interaction_user(i)
+	if user == nil || user.ID != state.Invoker {
+		respond_ephemeral(s, i, "Only "+member_name(state.Invoker)+" can answer this")
+		return state, false
+	}
+	return state, true
+}
+
+// Replace the message of a component, e.g. with the result of the choice, and take the components off
+func respond_update(s *discordgo.Session, i *discordgo.InteractionCreate, content string, embeds ...*discordgo.MessageEmbed) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Embeds:     embeds,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	checkError(err)
+}
+
+// A select menu of players, the values are WebApp ids
+func player_select_menu(customID string, players []web_player_t) []discordgo.MessageComponent {
+	var options []discordgo.SelectMenuOption
+	for i, p := range players {
+		if i == 25 { // discord's limit
+			break
+		}
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       p.WebName,
+			Value:       strconv.Itoa(p.WebUserId),
+			Description: fmt.Sprintf("%s, %s, %s", p.DiscordName, team_or_none(p.Team), tier_name(p.Tier)),
+		})
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.SelectMenu{CustomID: customID, Placeholder: "Choose a player", Options: options},
+	}}}
+}
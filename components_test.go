@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseComponentId(t *testing.T) {
+	tests := []struct {
+		name     string
+		customID string
+		want     component_state_t
+		wantErr  bool
+	}{
+		{"without arguments", "show:500:1", component_state_t{Feature: "show", Invoker: "500", Expires: time.Unix(1, 0), Args: []string{}}, false},
+		{"with arguments", "approval:500:zz:a1:approve", component_state_t{Feature: "approval", Invoker: "500", Expires: time.Unix(35*36+35, 0), Args: []string{"a1", "approve"}}, false},
+		{"empty argument", "link:500:1::", component_state_t{Feature: "link", Invoker: "500", Expires: time.Unix(1, 0), Args: []string{"", ""}}, false},
+		{"too short", "show:500", component_state_t{}, true},
+		{"bad expiry", "show:500:!", component_state_t{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse_component_id(tt.customID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse_component_id(%q) error = %v, want error %v", tt.customID, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse_component_id(%q) = %+v, want %+v", tt.customID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComponentIdRoundTrip(t *testing.T) {
+	customID := component_id("match", "500", time.Hour, "accept", "42", "600")
+	got, err := parse_component_id(customID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Feature != "match" || got.Invoker != "500" || !reflect.DeepEqual(got.Args, []string{"accept", "42", "600"}) {
+		t.Errorf("parse_component_id(%q) = %+v", customID, got)
+	}
+	if until := time.Until(got.Expires); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("expires in %s, want an hour", until)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// How long a conversation waits for an answer before it gives up
+const CONVERSATION_TTL time.Duration = 5 * time.Minute
+
+// How a step is answered
+type step_kind_t int
+
+const (
+	STEP_TEXT    step_kind_t = iota // a typed message
+	STEP_CHOICE                     // one of the options, buttons (up to 5) or a select menu, typing the number or value works too
+	STEP_CONFIRM                    // yes or no, as buttons or typed
+	STEP_MULTI                      // some of the options, a select menu or typed as a comma separated list, answered as "value,value"
+)
+
+// An option of a STEP_CHOICE step
+type conversation_option_t struct {
+	Label       string
+	Value       string // max 50 characters and no ":" or ",", ends up in the custom id of a button
+	Description string // shown in select menus only
+}
+
+// A single question of a conversation
+// The steps of a wizard are built in a function that keeps the wizard's state in local variables the closures share
+type conversation_step_t struct {
+	Name     string
+	Kind     step_kind_t
+	Prompt   func() string
+	Options  func() []conversation_option_t     // STEP_CHOICE and STEP_MULTI only
+	Validate func(input string) error           // optional, an error asks the question again
+	Answer   func(input string) (string, error) // returns the name of the next step, "" ends the conversation
+}
+
+// A multi-step exchange with one user in one channel
+type conversation_t struct {
+	Id        string
+	Command   string // shown in messages, e.g. "/deleteroles"
+	UserID    string
+	ChannelID string
+	Ctx       context.Context     // optional, the conversation ends when it's cancelled (e.g. by /cancel)
+	OnEnd     func(reason string) // optional, called once when the conversation ends for any reason
+	steps     map[string]conversation_step_t
+	step      string
+	promptID  string // message that holds the components of the current step
+	busy      bool   // a step is being answered, further input is ignored
+	timer     *time.Timer
+	done      chan struct{}
+	session   *discordgo.Session
+}
+
+var conversations = map[string]*conversation_t{} // [user id + channel id]conversation
+var conversationMutex sync.Mutex
+var conversationCounter int
+
+func conversation_key(userID string, channelID string) string {
+	return userID + ":" + channelID
+}
+
+// Create a conversation, the first step is asked first
+func new_conversation(command string, userID string, channelID string, steps ...conversation_step_t) *conversation_t {
+	c := &conversation_t{
+		Command:   command,
+		UserID:    userID,
+		ChannelID: channelID,
+		steps:     make(map[string]conversation_step_t),
+		done:      make(chan struct{}),
+		step:      steps[0].Name,
+	}
+	for _, step := range steps {
+		c.steps[step.Name] = step
+	}
+	return c
+}
+
+// Ask the first question, a conversation the user already has in this channel ends
+func start_conversation(s *discordgo.Session, c *conversation_t) {
+	conversationMutex.Lock()
+	conversationCounter++
+	c.Id = strconv.FormatInt(int64(conversationCounter), 36)
+	c.session = s
+	old := conversations[conversation_key(c.UserID, c.ChannelID)]
+	conversations[conversation_key(c.UserID, c.ChannelID)] = c
+	conversationMutex.Unlock()
+
+	if old != nil {
+		old.end("replaced by " + c.Command)
+	}
+	c.timer = time.AfterFunc(CONVERSATION_TTL, func() { c.end("timed out") })
+	if c.Ctx != nil {
+		go func() {
+			select {
+			case <-c.Ctx.Done():
+				c.end("cancelled")
+			case <-c.done:
+			}
+		}()
+	}
+	c.ask("")
+}
+
+// End the conversation, removes the components of the last prompt
+func (c *conversation_t) end(reason string) {
+	conversationMutex.Lock()
+	if conversations[conversation_key(c.UserID, c.ChannelID)] != c {
+		conversationMutex.Unlock()
+		return
+	}
+	delete(conversations, conversation_key(c.UserID, c.ChannelID))
+	conversationMutex.Unlock()
+
+	close(c.done)
+	c.timer.Stop()
+	c.clear_components()
+	if reason != "" {
+		_, err := c.session.ChannelMessageSend(c.ChannelID, DIFF_MSG_START+"- "+c.Command+" "+strings.ToUpper(reason)+DIFF_MSG_END)
+		checkError(err)
+	}
+	if c.OnEnd != nil {
+		c.OnEnd(reason)
+	}
+}
+
+// Send the prompt of the current step, problem is shown above it when the previous answer was invalid
+func (c *conversation_t) ask(problem string) {
+	c.clear_components() // an earlier prompt of the same step
+	step := c.steps[c.step]
+	content := step.Prompt()
+	if problem != "" {
+		content = DIFF_MSG_START + "- " + problem + DIFF_MSG_END + "\n" + content
+	}
+	chunks := split_message(content)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		_, err := c.session.ChannelMessageSend(c.ChannelID, chunk)
+		checkError(err)
+	}
+	msg, err := c.session.ChannelMessageSendComplex(c.ChannelID, &discordgo.MessageSend{
+		Content:    chunks[len(chunks)-1],
+		Components: c.components(step),
+	})
+	checkError(err)
+	if err == nil {
+		c.promptID = msg.ID
+	}
+}
+
+// conv:<user>:<expiry>:<conversation id>:<step>:<action>[:<value>], the ids tie a component to the step it was sent for
+func (c *conversation_t) custom_id(parts ...string) string {
+	return component_id("conv", c.UserID, CONVERSATION_TTL, append([]string{c.Id, c.step}, parts...)...)
+}
+
+func (c *conversation_t) components(step conversation_step_t) []discordgo.MessageComponent {
+	cancel := discordgo.Button{Label: "Cancel", Style: discordgo.SecondaryButton, CustomID: c.custom_id("cancel")}
+	switch step.Kind {
+	case STEP_CONFIRM:
+		return []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Yes", Style: discordgo.DangerButton, CustomID: c.custom_id("answer", "yes")},
+			cancel,
+		}}}
+	case STEP_CHOICE:
+		options := step.Options()
+		if len(options) <= 4 { // one row of buttons, with room for cancel
+			var buttons []discordgo.MessageComponent
+			for _, o := range options {
+				buttons = append(buttons, discordgo.Button{Label: o.Label, Style: discordgo.PrimaryButton, CustomID: c.custom_id("answer", o.Value)})
+			}
+			return []discordgo.MessageComponent{discordgo.ActionsRow{Components: append(buttons, cancel)}}
+		}
+		return []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{c.select_menu(options, 1, "Choose one")}},
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{cancel}},
+		}
+	case STEP_MULTI:
+		options := step.Options()
+		return []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{c.select_menu(options, len(options), "Choose one or more")}},
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{cancel}},
+		}
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{cancel}}}
+}
+
+func (c *conversation_t) select_menu(options []conversation_option_t, maxValues int, placeholder string) discordgo.SelectMenu {
+	var menu []discordgo.SelectMenuOption
+	for i, o := range options {
+		if i == 25 { // discord's limit, the rest can be typed
+			break
+		}
+		menu = append(menu, discordgo.SelectMenuOption{Label: o.Label, Value: o.Value, Description: o.Description})
+	}
+	if maxValues > len(menu) {
+		maxValues = len(menu)
+	}
+	minValues := 1
+	return discordgo.SelectMenu{CustomID: c.custom_id("select"), Placeholder: placeholder, MinValues: &minValues, MaxValues: maxValues, Options: menu}
+}
+
+// Take the components off the current prompt so it can't be answered twice
+func (c *conversation_t) clear_components() {
+	if c.promptID == "" {
+		return
+	}
+	_, err := c.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         c.promptID,
+		Channel:    c.ChannelID,
+		Components: []discordgo.MessageComponent{},
+	})
+	checkError(err)
+	c.promptID = ""
+}
+
+// Turn typed input into the value of the step, e.g. "2" into the value of the second option
+func (c *conversation_t) normalize(step conversation_step_t, input string) (string, error) {
+	input = strings.TrimSpace(input)
+	switch step.Kind {
+	case STEP_CONFIRM:
+		switch strings.ToLower(input) {
+		case "yes", "y":
+			return "yes", nil
+		case "no", "n":
+			return "no", nil
+		}
+		return "", fmt.Errorf("answer yes or no")
+	case STEP_CHOICE:
+		return match_option(step.Options(), input)
+	case STEP_MULTI:
+		options := step.Options()
+		var values []string
+		for _, part := range strings.Split(input, ",") {
+			value, err := match_option(options, strings.TrimSpace(part))
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	}
+	return input, nil
+}
+
+// An option by value, label or number (values win, so options numbered by their value work as expected)
+func match_option(options []conversation_option_t, input string) (string, error) {
+	for _, o := range options {
+		if strings.EqualFold(o.Value, input) || strings.EqualFold(o.Label, input) {
+			return o.Value, nil
+		}
+	}
+	if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(options) {
+		return options[n-1].Value, nil
+	}
+	return "", fmt.Errorf("%s is not one of the options", input)
+}
+
+// Feed an answer to the current step and move on to the next one
+func (c *conversation_t) handle(step string, input string) {
+	conversationMutex.Lock()
+	if c.busy || step != c.step {
+		conversationMutex.Unlock()
+		return
+	}
+	c.busy = true
+	conversationMutex.Unlock()
+	defer func() {
+		conversationMutex.Lock()
+		c.busy = false
+		conversationMutex.Unlock()
+	}()
+
+	if c.Ctx != nil && c.Ctx.Err() != nil {
+		c.end("cancelled")
+		return
+	}
+	current := c.steps[c.step]
+	value, err := c.normalize(current, input)
+	if err == nil && current.Kind == STEP_CONFIRM && value == "no" {
+		c.end("cancelled")
+		return
+	}
+	if err == nil && current.Validate != nil {
+		err = current.Validate(value)
+	}
+	if err != nil {
+		c.timer.Reset(CONVERSATION_TTL)
+		c.ask(err.Error())
+		return
+	}
+
+	c.timer.Stop() // answering may take a while, e.g. deleting roles
+	c.clear_components()
+	next, err := current.Answer(value)
+	if err != nil {
+		_, err = c.session.ChannelMessageSend(c.ChannelID, DIFF_MSG_START+"- "+c.Command+" ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		c.end("")
+		return
+	}
+	if next == "" {
+		c.end("")
+		return
+	}
+	conversationMutex.Lock()
+	c.step = next
+	conversationMutex.Unlock()
+	c.timer.Reset(CONVERSATION_TTL)
+	c.ask("")
+}
+
+// Returns the conversation of a user in a channel, nil if there is none
+func find_conversation(userID string, channelID string) *conversation_t {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	return conversations[conversation_key(userID, channelID)]
+}
+
+func (c *conversation_t) current_step() string {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	return c.step
+}
+
+// Returns the conversation with the given id, nil if it ended
+func find_conversation_by_id(id string) *conversation_t {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	for _, c := range conversations {
+		if c.Id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Answer a conversation with a typed message, returns true if the message was part of a conversation
+// Commands are never taken as an answer, so /status and /cancel keep working mid-conversation
+func handle_conversation_message(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	c := find_conversation(m.Author.ID, m.ChannelID)
+	if c == nil || strings.HasPrefix(m.Content, "/") {
+		return false
+	}
+	if strings.EqualFold(strings.TrimSpace(m.Content), "cancel") {
+		c.end("cancelled")
+		return true
+	}
+	c.handle(c.current_step(), m.Content)
+	return true
+}
+
+// Answer a conversation with a button or select menu
+// The actions are answer:<value> for buttons, select for select menus and cancel
+func handle_conversation_component(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	state, ok := authorize_component(s, i)
+	if !ok {
+		return
+	}
+	args := state.Args // <conversation id>:<step>:<action>[:<value>]
+	if len(args) < 3 {
+		return
+	}
+	c := find_conversation_by_id(args[0])
+	if c == nil || c.current_step() != args[1] {
+		respond_ephemeral(s, i, "This prompt has expired")
+		return
+	}
+
+	// acknowledge right away, answering may take longer than discord waits for a response
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate})
+	checkError(err)
+	switch {
+	case args[2] == "cancel":
+		c.end("cancelled")
+	case args[2] == "select" && len(i.MessageComponentData().Values) > 0:
+		c.handle(args[1], strings.Join(i.MessageComponentData().Values, ","))
+	case args[2] == "answer" && len(args) == 4:
+		c.handle(args[1], args[3])
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+// Replace the roster for the test, it's put back afterwards
+func use_test_roster(t *testing.T, players ...web_player_t) {
+	savedPlayers, savedNames := mapWebUserIdToPlayer, mapWebUserNameToWebUserId
+	t.Cleanup(func() { mapWebUserIdToPlayer, mapWebUserNameToWebUserId = savedPlayers, savedNames })
+	mapWebUserIdToPlayer = map[int]web_player_t{}
+	mapWebUserNameToWebUserId = map[string]int{}
+	for _, p := range players {
+		mapWebUserIdToPlayer[p.WebUserId] = p
+		mapWebUserNameToWebUserId[p.WebName] = p.WebUserId
+	}
+}
+
+// Replace the team registry for the test, it's put back afterwards
+func use_test_teams(t *testing.T, teams ...registered_team_t) {
+	saved := mapTeamRegistry
+	t.Cleanup(func() { mapTeamRegistry = saved })
+	mapTeamRegistry = map[string]registered_team_t{}
+	for _, team := range teams {
+		mapTeamRegistry[team.Role_id] = team
+	}
+}
+
+// Replace the grants and command overrides for the test, they're put back afterwards
+func use_test_permissions(t *testing.T, users map[string]permission_level_t, roles map[string]permission_level_t, commands map[string]permission_level_t) {
+	savedUsers, savedRoles, savedCommands := mapUserPermissions, mapRolePermissions, mapCommandPermissions
+	t.Cleanup(func() {
+		mapUserPermissions, mapRolePermissions, mapCommandPermissions = savedUsers, savedRoles, savedCommands
+	})
+	mapUserPermissions, mapRolePermissions, mapCommandPermissions = users, roles, commands
+}
+
+// Replace the appointed assistant coaches for the test, they're put back afterwards
+func use_test_assistants(t *testing.T, assistants map[int]assistant_coach_t) {
+	saved := mapAssistantCoaches
+	t.Cleanup(func() { mapAssistantCoaches = saved })
+	mapAssistantCoaches = assistants
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single player change pushed by the WebApp
+type player_change_event_t struct {
+	Event  string       `json:"event"` // e.g. "player_updated"
+	Player web_player_t `json:"player"`
+}
+
+// Serve the endpoints the WebApp talks to (blocks, run in a goroutine)
+func start_http_server() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook/player", handle_player_webhook)
+	mux.HandleFunc("/link/create", handle_link_create)
+	mux.HandleFunc("/link/start", handle_link_start)
+	mux.HandleFunc("/link/callback", handle_link_callback)
+	mux.HandleFunc("/healthz", handle_healthz)
+	mux.HandleFunc("/readyz", handle_readyz)
+
+	// /metrics is for the operators only, it stays off the public listener
+	metricsMux := http.NewServeMux()
+	metricsMux.HandleFunc("/metrics", handle_metrics)
+	go func() {
+		log_info("metrics server listening", log_fields{"addr": METRICS_LISTEN_ADDR})
+		err := http.ListenAndServe(METRICS_LISTEN_ADDR, metricsMux)
+		checkError(err)
+	}()
+
+	log_info("HTTP server listening", log_fields{"addr": HTTP_LISTEN_ADDR})
+	err := http.ListenAndServe(HTTP_LISTEN_ADDR, mux)
+	checkError(err)
+}
+
+var seenWebhookSignatures = map[string]time.Time{} // [signature]when it was accepted, to reject replays
+var seenWebhookSignaturesMutex sync.Mutex
+
+// Returns the HMAC-SHA256 of "<timestamp>.<body>" with the shared webhook secret
+func webhook_hmac(timestamp string, body []byte) ([]byte, error) {
+	secret, err := ioutil.ReadFile("./keys/webhook_secret")
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(string(secret))))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil), nil
+}
+
+// Returns the X-Starbot-Timestamp and X-Starbot-Signature header values for a body we send to the WebApp
+func sign_webhook_body(body []byte) (string, string, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sum, err := webhook_hmac(timestamp, body)
+	if err != nil {
+		return "", "", err
+	}
+	return timestamp, "sha256=" + hex.EncodeToString(sum), nil
+}
+
+// Returns nil if the request body was signed with the shared webhook secret, at most WEBHOOK_MAX_AGE ago, and not seen before
+// The WebApp sends "X-Starbot-Timestamp: <unix seconds>" and "X-Starbot-Signature: sha256=<hex hmac of timestamp.body>"
+func verify_webhook_request(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get("X-Starbot-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing timestamp")
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > WEBHOOK_MAX_AGE || age < -WEBHOOK_MAX_AGE {
+		return fmt.Errorf("timestamp outside of the allowed window")
+	}
+	expected, err := webhook_hmac(timestamp, body)
+	if err != nil {
+		checkError(err)
+		return fmt.Errorf("invalid signature")
+	}
+	header := r.Header.Get("X-Starbot-Signature")
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || !hmac.Equal(signature, expected) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	// the same signed request within the window is a replay
+	seenWebhookSignaturesMutex.Lock()
+	defer seenWebhookSignaturesMutex.Unlock()
+	for sig, at := range seenWebhookSignatures {
+		if time.Since(at) > 2*WEBHOOK_MAX_AGE {
+			delete(seenWebhookSignatures, sig)
+		}
+	}
+	if _, seen := seenWebhookSignatures[header]; seen {
+		return fmt.Errorf("request was already received")
+	}
+	seenWebhookSignatures[header] = time.Now()
+	return nil
+}
+
+// Update one player from a WebApp change event and reconcile only their discord roles
+func handle_player_webhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if err := verify_webhook_request(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var event player_change_event_t
+	err = json.Unmarshal(body, &event)
+	if err == nil {
+		err = validate_web_players([]web_player_t{event.Player})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Store the new record, the WebApp doesn't know the discord id we resolved
+	player, err := merge_web_player(event.Player)
+	checkError(err)
+
+	result := map[string]interface{}{"status": "stored"}
+	if player.Discord_id != "" && discord_id_exists(player.Discord_id) && !player.Left_server {
+		changes, err := sync_player_roles(botSession, player)
+		result["changes"] = changes
+		entry := audit_entry_t{
+			Actor:   "webapp",
+			Command: "webhook " + event.Event,
+			Action:  "member_roles",
+			Target:  fmt.Sprintf("%s (%s)", player.WebName, player.Discord_id),
+			After:   strings.Join(changes, " "),
+			Result:  audit_result(err),
+		}
+		if len(changes) > 0 || err != nil {
+			append_audit_log(entry)
+		}
+		if err != nil {
+			result["status"] = "error"
+			result["error"] = err.Error()
+			send_staff_message(botSession, fmt.Sprintf("> WebApp update for <@%s> %s failed: %s", player.Discord_id, player.WebName, err))
+		} else {
+			result["status"] = "synced"
+			if len(changes) > 0 {
+				send_staff_message(botSession, fmt.Sprintf("> WebApp update for <@%s> %s: %s", player.Discord_id, player.WebName, strings.Join(changes, " ")))
+			}
+		}
+	} else {
+		send_staff_message(botSession, fmt.Sprintf("> WebApp update for %s stored, not found on the server", player.WebName))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	checkError(err)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// A binding between a web player and a discord account made by an admin
+// An empty DiscordId means an admin unlinked the player on purpose
+type manual_link_t struct {
+	DiscordId string
+	LinkedBy  string // discord id of the admin
+	LinkedAt  time.Time
+}
+
+var mapManualLinks = map[int]manual_link_t{} // [WebUserId]link, authoritative over name matching in scans
+
+var mentionRegex = regexp.MustCompile(`^<@!?(\d+)>$`)
+
+// Returns the discord id from a mention or a plain snowflake id
+func parse_member_argument(arg string) (string, bool) {
+	if match := mentionRegex.FindStringSubmatch(arg); match != nil {
+		return match[1], true
+	}
+	if _, err := strconv.ParseUint(arg, 10, 64); err == nil && len(arg) >= 17 {
+		return arg, true
+	}
+	return "", false
+}
+
+// Returns the web player from a WebApp user id or web name (exact first, then case-insensitive)
+func find_web_player(arg string) (web_player_t, error) {
+	if id, err := strconv.Atoi(arg); err == nil {
+		if player, ok := get_web_player(id); ok {
+			return player, nil
+		}
+	}
+	if id, ok := get_web_id_by_name(arg); ok {
+		if player, found := get_web_player(id); found {
+			return player, nil
+		}
+	}
+	found := web_players_named(arg)
+	switch len(found) {
+	case 0:
+		return web_player_t{}, fmt.Errorf("no web player named %s", arg)
+	case 1:
+		return found[0], nil
+	}
+	return web_player_t{}, fmt.Errorf("%d web players are named %s, use the WebApp id", len(found), arg)
+}
+
+// Every web player whose web name equals name, ignoring case
+func web_players_named(name string) []web_player_t {
+	var found []web_player_t
+	for _, player := range all_web_players() {
+		if strings.EqualFold(player.WebName, name) {
+			found = append(found, player)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].WebUserId < found[j].WebUserId })
+	return found
+}
+
+// Set (or clear, if discordId is empty) the discord account of a web player on behalf of an admin
+// command is recorded in the audit log as the cause of the change
+func set_manual_link(player web_player_t, discordId string, adminId string, command string) {
+	rosterMutex.Lock()
+	defer rosterMutex.Unlock()
+	set_manual_link_locked(player, discordId, adminId, command)
+}
+
+// set_manual_link for callers that already hold rosterMutex, e.g. to check and link in one go
+func set_manual_link_locked(player web_player_t, discordId string, adminId string, command string) {
+	before := player.Discord_id
+	mapManualLinks[player.WebUserId] = manual_link_t{
+		DiscordId: discordId,
+		LinkedBy:  adminId,
+		LinkedAt:  time.Now().UTC(),
+	}
+	player.Discord_id = discordId
+	player.Left_server = false
+	mapWebUserIdToPlayer[player.WebUserId] = player
+	delete(mapMatchReviews, player.WebUserId)
+
+	err := store_data(mapManualLinks, "mapManualLinks")
+	if rosterErr := store_data(mapWebUserIdToPlayer, "mapWebUserIdToPlayer"); err == nil {
+		err = rosterErr
+	}
+	if reviewErr := store_data(mapMatchReviews, "mapMatchReviews"); err == nil {
+		err = reviewErr
+	}
+
+	action := "link"
+	if discordId == "" {
+		action = "unlink"
+	}
+	append_audit_log(audit_entry_t{
+		Actor:   adminId,
+		Command: command,
+		Action:  action,
+		Target:  fmt.Sprintf("%s (%d)", player.WebName, player.WebUserId),
+		Before:  before,
+		After:   discordId,
+		Result:  audit_result(err),
+	})
+}
+
+// /link <web name or id> @member
+func link_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	outcome := "error"
+	defer func() { record_command("/link", outcome) }()
+	args := strings.Fields(strings.TrimPrefix(m.Content, "/link"))
+	if len(args) < 2 {
+		_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /link ERROR: usage /link <web name or id> @member"+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	discordId, ok := parse_member_argument(args[len(args)-1])
+	if !ok {
+		_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /link ERROR: "+args[len(args)-1]+" is not a member mention or id"+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	name := strings.Join(args[:len(args)-1], " ")
+	if namesakes := web_players_named(name); len(namesakes) > 1 {
+		_, err := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content:    fmt.Sprintf("**%d web players are named %s**, choose the one to link to <@%s>:", len(namesakes), name, discordId),
+			Components: player_select_menu(component_id("link", m.Author.ID, COMPONENT_TTL, discordId), namesakes),
+		})
+		checkError(err)
+		outcome = "ambiguous"
+		return
+	}
+	player, err := find_web_player(name)
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /link ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	message, err := link_player(s, player, discordId, m.Author.ID)
+	if err != nil {
+		message = DIFF_MSG_START + "- /link ERROR: " + err.Error() + DIFF_MSG_END
+	} else {
+		outcome = "ok"
+	}
+	_, err = s.ChannelMessageSend(m.ChannelID, message)
+	checkError(err)
+}
+
+// Link player to the member after checking the member may be linked, returns the message to show
+func link_player(s *discordgo.Session, player web_player_t, discordId string, adminId string) (string, error) {
+	if _, err := get_guild_member(s, discordId); err != nil {
+		return "", fmt.Errorf("member %s not found on the server", discordId)
+	}
+	if webId, linked := get_web_id_by_discord_id(discordId); linked && webId != player.WebUserId {
+		linked, _ := get_web_player(webId)
+		return "", fmt.Errorf("member is already linked to %s", linked.WebName)
+	}
+	set_manual_link(player, discordId, adminId, "/link")
+	return fmt.Sprintf("%s+ /link DONE%s> %s (%d) is now linked to <@%s>", DIFF_MSG_START, DIFF_MSG_END, player.WebName, player.WebUserId, discordId), nil
+}
+
+// The player chosen from the select menu of a /link whose web name is shared
+// link:<invoker>:<expiry>:<DiscordId>
+func handle_link_component(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	state, ok := authorize_component(s, i)
+	if !ok {
+		return
+	}
+	values := i.MessageComponentData().Values
+	if len(values) == 0 || len(state.Args) != 1 || !user_is_authorized(s, state.Invoker, "/link") {
+		return
+	}
+	webId, _ := strconv.Atoi(values[0])
+	player, found := get_web_player(webId)
+	if !found {
+		respond_update(s, i, DIFF_MSG_START+"- /link ERROR: player "+values[0]+" is no longer on the roster"+DIFF_MSG_END)
+		record_command("/link", "error")
+		return
+	}
+	message, err := link_player(s, player, state.Args[0], state.Invoker)
+	record_command("/link", command_outcome(err))
+	if err != nil {
+		message = DIFF_MSG_START + "- /link ERROR: " + err.Error() + DIFF_MSG_END
+	}
+	respond_update(s, i, message)
+}
+
+// /unlink <web name or id>
+func unlink_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	outcome := "error"
+	defer func() { record_command("/unlink", outcome) }()
+	arg := strings.TrimSpace(strings.TrimPrefix(m.Content, "/unlink"))
+	if arg == "" {
+		_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /unlink ERROR: usage /unlink <web name or id>"+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	player, err := find_web_player(arg)
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /unlink ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+
+	set_manual_link(player, "", m.Author.ID, "/unlink")
+	outcome = "ok"
+	_, err = s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s+ /unlink DONE%s> %s (%d) is no longer linked, use /link to bind them again", DIFF_MSG_START, DIFF_MSG_END, player.WebName, player.WebUserId))
+	checkError(err)
+}
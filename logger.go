@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Log levels, lines below STARBOT_LOG_LEVEL (debug, info, warn, error - default info) are dropped
+type log_level_t int
+
+const (
+	LOG_DEBUG log_level_t = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var LOG_LEVEL_NAMES = map[log_level_t]string{
+	LOG_DEBUG: "debug",
+	LOG_INFO:  "info",
+	LOG_WARN:  "warn",
+	LOG_ERROR: "error",
+}
+
+// Extra context of a log line, use the keys command, guild, member and role where they apply
+type log_fields map[string]interface{}
+
+var logLevel = log_level_from_env()
+var logOutput io.Writer = os.Stdout // one JSON object per line
+var logMutex sync.Mutex
+
+// The user-facing match and clip report (log.html), kept apart from the operational log
+var reportLog = log.New(ioutil.Discard, "", log.LstdFlags)
+
+func log_level_from_env() log_level_t {
+	for level, name := range LOG_LEVEL_NAMES {
+		if strings.EqualFold(os.Getenv("STARBOT_LOG_LEVEL"), name) {
+			return level
+		}
+	}
+	return LOG_INFO
+}
+
+// Write a single structured log line
+func log_event(level log_level_t, msg string, fields log_fields) {
+	if level < logLevel {
+		return
+	}
+	line := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok { // errors don't marshal to anything useful
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = LOG_LEVEL_NAMES[level]
+	line["msg"] = msg
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","msg":"could not marshal log line: %s"}`, err))
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	_, _ = logOutput.Write(append(data, '\n'))
+}
+
+func log_debug(msg string, fields log_fields) { log_event(LOG_DEBUG, msg, fields) }
+func log_info(msg string, fields log_fields)  { log_event(LOG_INFO, msg, fields) }
+func log_warn(msg string, fields log_fields)  { log_event(LOG_WARN, msg, fields) }
+
+// Log an error with the file and line of the caller
+func log_error(msg string, err error, fields log_fields) {
+	line := log_fields{"error": err, "caller": caller_location(1)}
+	for k, v := range fields {
+		line[k] = v
+	}
+	log_event(LOG_ERROR, msg, line)
+}
+
+// file:line of the function skip levels above the caller of caller_location
+func caller_location(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", filepath.Base(file), line)
+}
+
+// The fields of a text command, for every log line about it
+func command_fields(m *discordgo.MessageCreate) log_fields {
+	command := strings.Fields(m.Content)
+	fields := log_fields{"guild": m.GuildID, "channel": m.ChannelID}
+	if len(command) > 0 {
+		fields["command"] = command[0]
+	}
+	if m.Author != nil {
+		fields["member"] = m.Author.ID
+	}
+	return fields
+}
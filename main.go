@@ -4,21 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
-	"unicode"
+	"time"
 
 	//third party dependencies:
 	"github.com/bwmarrin/discordgo"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/sheets/v4"
 )
 
 /* #####
@@ -39,6 +36,42 @@ var IS_PRIVILEGED_USER = map[string]bool{
 	"93204976779694080":  true, //Pete aka Pusagi
 }
 
+// Permission level each command needs, /perm command can override the levels below admin
+var COMMAND_PERMISSIONS = map[string]permission_level_t{
+	"/scan_users":          PERM_ADMIN,
+	"/assignroles":         PERM_ADMIN,
+	"/webassignroles":      PERM_ADMIN,
+	"/deleteroles":         PERM_ADMIN,
+	"/fetchplayers":        PERM_ADMIN,
+	"/uploadplayers":       PERM_ADMIN,
+	"/parse_past_messages": PERM_ADMIN,
+	"/team":                PERM_ADMIN,
+	"/status":              PERM_ADMIN,
+	"/cancel":              PERM_ADMIN,
+	"/snapshot":            PERM_ADMIN,
+	"/audit":               PERM_ADMIN,
+	"/link":                PERM_ADMIN,
+	"/unlink":              PERM_ADMIN,
+	"/perm":                PERM_ADMIN,
+	"/roster":              PERM_PRIVILEGED,
+	"/show":                PERM_PRIVILEGED,
+	"/myteam":              PERM_CAPTAIN,
+}
+
+// Destructive commands that only run once a second admin approved them, remove a command to let a single admin run it
+var REQUIRES_APPROVAL = map[string]bool{
+	"/deleteroles":      true,
+	"/snapshot restore": true,
+}
+
+// What happens while IS_AUTHORIZED_AS_ADMIN has no other admin who could approve:
+// true  - the command is refused until a second admin is added
+// false - opt-in for a single admin, the requester confirms the command themselves (audited as approval_self)
+const REQUIRE_SECOND_APPROVER bool = true
+
+// How long a destructive command waits for the second admin
+const APPROVAL_WINDOW time.Duration = 15 * time.Minute
+
 // CPL SERVER VALUES: (MASTER BRANCH)
 const SPREADSHEET_ID string = "1Xd0ohSMrYKsB-d0g3OgbovA3BV4NntQg_ZXjDJ7js8I" // CPL MASTER SPREADSHEET ID
 const DISCORD_SERVER_ID string = "426172214677602304"                        // CPL SERVER
@@ -53,12 +86,28 @@ const TIER2_ROLE_ID string = "486932586724065285"
 const TIER3_ROLE_ID string = "486932645519818752"
 const COACH_ROLE_ID string = "426370872740413440"
 const ASST_COACH_ROLE_ID string = "514179771295334420"
-const TEAM1_ROLE_ID string = "952362058282836079"
-const TEAM2_ROLE_ID string = "952363361360810015"
-const TEAM3_ROLE_ID string = "952363465299853373"
-const TEAM4_ROLE_ID string = "952363498233536533"
-const TEAM5_ROLE_ID string = "952363548166750259"
-const TEAM6_ROLE_ID string = "952363607616794624"
+const STAFF_CHANNEL_ID string = "" // Staff channel for bot notices (leave empty to disable)
+const STAFF_ROLE_ID string = ""    // Staff role that can see all team channels (team channels aren't created while empty)
+const AUDIT_CHANNEL_ID string = "" // Staff mod-log channel that mirrors the audit log (leave empty to disable)
+
+// WebApp export of players.json (leave empty to fall back to ./data/players.json)
+// The bearer token for the export is read from ./keys/webapp_token
+const WEBAPP_PLAYERS_URL string = ""
+
+// Address of the HTTP server for WebApp webhooks (the shared HMAC secret is read from ./keys/webhook_secret)
+const HTTP_LISTEN_ADDR string = ":8080"
+
+// Address of the /metrics endpoint, only reachable from the host itself (or a scraper on it)
+const METRICS_LISTEN_ADDR string = "127.0.0.1:9090"
+
+// Signed webhook requests older (or newer) than this are rejected, so a captured request can't be replayed later
+const WEBHOOK_MAX_AGE = 5 * time.Minute
+
+// Discord OAuth2 application for self-service account linking (client secret is read from ./keys/oauth_client_secret)
+const OAUTH_CLIENT_ID string = ""
+const OAUTH_PUBLIC_URL string = "http://localhost:8080"               // where players can reach the HTTP server
+const OAUTH_REDIRECT_URL string = OAUTH_PUBLIC_URL + "/link/callback" // must be registered in the discord application
+const WEBAPP_LINK_RESULT_URL string = ""                              // WebApp endpoint that receives verified links
 
 //// TEST SERVER VALUESL (TESTING BRANCH)
 //const CPL_CLIPS_CHANNEL_ID string = "945364478973861898"                     // TEST SERVER CLIPS CHANNEL
@@ -95,9 +144,22 @@ const AVAILABLE_COMMANDS string = `
 [ /test           - test command                      ]
 [                                                     ]
 [ /scan_users     - identify users based on web info  ]
+[ /fetchplayers   - refresh players.json from WebApp  ]
+[ /uploadplayers  - replace roster with attached json ]
+[ /roster missing - players not found on the server   ]
+[ /show <player>  - player profile (mention/id/name)  ]
+[ /link           - bind web player to discord member ]
+[ /unlink         - clear a web player's discord link ]
+[ /team           - create/rename/color/archive teams ]
 [ /assignroles    - assign roles based on players json]
 [ /webassignroles - create and assign roles from sheet]
 [ /deleteroles    - delete previously created roles   ]
+[ /snapshot       - create/list/diff/restore roles    ]
+[ /status         - show the dangerous command running]
+[ /cancel         - abort the dangerous command       ]
+[ /audit          - who ran what: [@user] [/cmd] [7d] ]
+[ /perm           - list/grant/revoke/command levels  ]
+[ /myteam         - roster/assistant/announce (leads) ]
 `
 
 const MATCH_REPORT_FORMAT_HELP_TEXT string = "G2: player_name 1-0 player_two\n```"
@@ -145,6 +207,11 @@ type team_t struct {
 	Members    []user_t
 	Color      int
 	Exists     bool
+	// Channels created for the team, deleted together with the batch
+	Category_id      string
+	Text_channel_id  string
+	Voice_channel_id string
+	Channels_only    bool // the role existed before the batch, only the channels belong to it
 	//mentionable        bool
 	//perms              int64
 	//fully_created_role discordgo.Role
@@ -174,15 +241,8 @@ type web_player_t struct { // use this if the json data has different name than
 	Losses                int
 	Ties                  int
 	Discord_id            string
-}
-
-// Struct to keep track of how /assignroles is being used (we want to disallow multiple simultanious use)
-type dangerousCommands_t struct {
-	isInUse   bool               //is set to true if command is in use
-	AuthorID  string             //author who last initiated /assignroles
-	ChannelID string             //channel where /assignroles was initiated from
-	session   *discordgo.Session //the current session
-	cmdName   string
+	Left_server           bool      `json:"-"` // set when the linked discord account leaves the server
+	Left_at               time.Time `json:"-"`
 }
 
 //##### End of data structures
@@ -191,26 +251,25 @@ type dangerousCommands_t struct {
 Global vars
 ##### */
 var TOKEN string                          //discord api token
-var NEW_BATCH_NAME string                 // Name of a batch of newly created roles
+var botSession *discordgo.Session         // the discord session, for code that doesn't run in a discord event handler
 var newlyCreatedRoles []string            // Holds newly created discord role IDs
 var newlyAssignedRoles [][2]string        // [roleid][userid]
-var dangerousCommands dangerousCommands_t // Info about /update roles command while being used
 var discordUsers = []*discordgo.Member{}  // slice of all users from discord
 // Maps
-var mapDiscordNameToCordID = map[string]string{}     // Used to lookup discordid from discord name
-var mapDiscordIdExists = map[string]bool{}           // Used to check if the user exists on the server
-var mapExistingDiscordRoles = map[string]bool{}      // Used to check if the role exists on the server
-var mapBatchesOfCreatedRoles = map[string][]team_t{} // [batchName]{roleid, roleid, roleid, roleid}
-var mapWebUserNameToWebUserId = map[string]int{}     // map of WebApp username to numerical WebApp user ID
-var mapWebUserIdToPlayer = map[int]web_player_t{}    // this is the main map I want to use for accessing player data
+var mapDiscordNameToCordID = map[string]string{}  // Used to lookup discordid from discord name
+var mapDiscordIdExists = map[string]bool{}        // Used to check if the user exists on the server
+var mapExistingDiscordRoles = map[string]bool{}   // Used to check if the role exists on the server
+var mapWebUserNameToWebUserId = map[string]int{}  // map of WebApp username to numerical WebApp user ID
+var mapWebUserIdToPlayer = map[int]web_player_t{} // this is the main map I want to use for accessing player data
 
 //##### End of global vars
 
 // error check as a func because it's annoying to write "if err != nil { ... }" over and over
+// Log errors that can't be handled any further (e.g. a reply that couldn't be sent)
+// Errors a command depends on are returned instead, so the command can report them
 func checkError(err error) {
 	if err != nil {
-		fmt.Println(err)
-		//panic(err.Error()rolesCmd_rolesCmd_ss)
+		log_event(LOG_ERROR, err.Error(), log_fields{"caller": caller_location(1)})
 	}
 }
 
@@ -226,85 +285,119 @@ func scan_message(s *discordgo.Session, m *discordgo.MessageCreate) {
 		parse_message_in_clips_channel(s, m)
 	}
 
-	// Trigger on interactive command
-	if dangerousCommands.isInUse && m.Author.ID == dangerousCommands.AuthorID && IS_AUTHORIZED_AS_ADMIN[m.Author.ID] {
-		switch dangerousCommands.cmdName {
+	// Record who ran which privileged command before it changes anything
+	if fields := strings.Fields(m.Content); len(fields) > 0 && AUDITED_COMMANDS[fields[0]] && is_authorized(s, m, fields[0]) {
+		audit_command_invocation(m)
+	}
 
-		case "/deleteroles":
-			if deleteroles_check_input(m.Content) {
-				deleteroles(s, m, m.Content) // run role deletion
-			} else {
-				reset_dangerous_commands_status()
-				_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /deleteroles ERROR: INVALID SELECTION"+DIFF_MSG_END)
-				checkError(err)
-			}
-		}
+	// Answers to interactive commands
+	if handle_conversation_message(s, m) {
+		return
 	}
 
 	// Handle first use and non-interactive commands
 	switch m.Content {
 	case "/scan_users":
-		if !IS_AUTHORIZED_AS_ADMIN[m.Author.ID] { // Check for Authorization
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /scan_missing ERROR: "+m.Author.Username+" IS NOT AUTHORIZED"+DIFF_MSG_END)
-			checkError(err)
+		if !is_authorized(s, m, "/scan_users") { // Check for Authorization
+			send_not_authorized(s, m, "/scan_missing")
 			return
 		} else {
-			if dangerousCommands.isInUse { // One at a time
-				_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /scan_missing ERROR: Dangerous command is in use\n"+DIFF_MSG_END)
+			op, err := start_operation(m.Author.ID, "/scan_users", m.ChannelID, RUNNING_LOCK_TTL) // One at a time
+			if err != nil {
+				_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /scan_missing ERROR: "+err.Error()+DIFF_MSG_END)
 				checkError(err)
 				return
 			}
-			dangerousCommands.isInUse = true
-			dangerousCommands.cmdName = "/scan_missing"
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"+ /scan_missing SCAN STARTING"+DIFF_MSG_END)
-			scan_web_players(s, m) //run the scan
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"+ /scan_missing SCAN STARTING"+DIFF_MSG_END)
 			checkError(err)
+			err = scan_web_players(op.ctx, s, m) //run the scan
+			outcome := command_outcome(err)
+			if err == nil && op.ctx.Err() != nil {
+				outcome = "cancelled"
+			}
+			op.release()
+			record_command("/scan_users", outcome)
+			if err != nil {
+				log_error("/scan_users failed", err, command_fields(m))
+				_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /scan_missing ERROR: "+err.Error()+DIFF_MSG_END)
+				checkError(err)
+			}
 		}
 
 	case "/assignroles":
-		if !IS_AUTHORIZED_AS_ADMIN[m.Author.ID] { // Check for Authorization
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /assignroles ERROR: "+m.Author.Username+" IS NOT AUTHORIZED"+DIFF_MSG_END)
+		if !is_authorized(s, m, "/assignroles") { // Check for Authorization
+			send_not_authorized(s, m, "/assignroles")
+			return
+		}
+		op, err := start_operation(m.Author.ID, "/assignroles", m.ChannelID, PROMPT_LOCK_TTL)
+		if err != nil {
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /assignroles ERROR: "+err.Error()+DIFF_MSG_END)
 			checkError(err)
 			return
 		}
-		if dangerousCommands.isInUse {
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /assignroles ERROR: Dangerous command is in use\n"+DIFF_MSG_END)
+		if !start_assignroles_conversation(s, m, op) { // Show how many roles would change and ask before changing them
+			op.release()
+		}
+
+	case "/deleteroles":
+		if !is_authorized(s, m, "/deleteroles") { // Check for Authorization
+			send_not_authorized(s, m, "/deleteroles")
+			return
+		}
+		op, err := start_operation(m.Author.ID, "/deleteroles", m.ChannelID, PROMPT_LOCK_TTL) // only one at a time is allowed
+		if err != nil {
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /deleteroles ERROR: "+err.Error()+DIFF_MSG_END)
+			checkError(err)
+			return
+		}
+		if !start_deleteroles_conversation(s, m, op) { // Show available batches and prompt user selection
+			op.release()
+		}
+
+	case "/fetchplayers":
+		if !is_authorized(s, m, "/fetchplayers") { // Check for Authorization
+			send_not_authorized(s, m, "/fetchplayers")
+			return
+		}
+		err := refresh_web_players(s)
+		record_command("/fetchplayers", command_outcome(err))
+		if err != nil {
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /fetchplayers ERROR: "+err.Error()+DIFF_MSG_END)
 			checkError(err)
 			return
 		}
-		_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+"+ /assignroles ROLE ASSIGNMENT STARTED"+FIX_MSG_END)
+		message := fmt.Sprintf("+ /fetchplayers DONE\n%d players, last downloaded %s", count_web_players(), webappCache.FetchedAt.Format(time.RFC1123))
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+message+DIFF_MSG_END)
 		checkError(err)
-		assign_roles_from_json(s, m)
 
-	case "/deleteroles":
-		if !IS_AUTHORIZED_AS_ADMIN[m.Author.ID] { // Check for Authorization
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /deleteroles ERROR: "+m.Author.Username+" IS NOT AUTHORIZED"+DIFF_MSG_END)
+	case "/uploadplayers":
+		if !is_authorized(s, m, "/uploadplayers") { // Check for Authorization
+			send_not_authorized(s, m, "/uploadplayers")
+			return
+		}
+		op, err := start_operation(m.Author.ID, "/uploadplayers", m.ChannelID, PROMPT_LOCK_TTL)
+		if err != nil {
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /uploadplayers ERROR: "+err.Error()+DIFF_MSG_END)
 			checkError(err)
 			return
 		}
-		if !dangerousCommands.isInUse { // Check if dangerous commands are available (onely one at a time is allowed)
-			dangerousCommands.isInUse = true
-			dangerousCommands.session = s
-			dangerousCommands.AuthorID = m.Author.ID
-			dangerousCommands.ChannelID = m.ChannelID
-			dangerousCommands.cmdName = "/deleteroles"
-			select_batch_to_delete(s, m) // Show available batches and prompt user selection
-		} else {
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /deleteroles ERROR: "+m.Author.Username+" DANGEROUS COMMAND IS IN USE"+DIFF_MSG_END)
-			if err != nil {
-				fmt.Println(err)
-			}
+		if !upload_web_players(s, m, op) { // Show the diff and prompt for confirmation
+			op.release()
+		}
+
+	case "/roster missing":
+		if !is_authorized(s, m, "/roster") {
+			send_not_authorized(s, m, "/roster")
 			return
 		}
+		send_long_message(s, m.ChannelID, roster_missing_report())
 
 	case "/get_discord_server_id": // Prints the ID of the discord server
 		_, err := s.ChannelMessageSend(m.ChannelID, m.GuildID)
-		if err != nil {
-			fmt.Println(err)
-		}
+		checkError(err)
 
 	case "/parse_past_messages":
-		if IS_AUTHORIZED_AS_ADMIN[m.Author.ID] {
+		if is_authorized(s, m, "/parse_past_messages") {
 			parse_past_messages(s, m)
 			_, err := s.ChannelMessageSend(m.ChannelID, "/parse_past_messages complete\n")
 			checkError(err)
@@ -315,82 +408,77 @@ func scan_message(s *discordgo.Session, m *discordgo.MessageCreate) {
 		checkError(err)
 
 	case "/webassignroles":
-		if dangerousCommands.isInUse { //check if this command is in use first and disallow simultanious use
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /webassignroles ERROR: EXECUTION IN PROGRESS"+DIFF_MSG_END)
+		if is_authorized(s, m, "/webassignroles") { // if the user is authorized, proceed with the operation
+			op, err := start_operation(m.Author.ID, "/webassignroles", m.ChannelID, RUNNING_LOCK_TTL) // disallow simultanious use
 			if err != nil {
-				fmt.Println(err)
+				_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /webassignroles ERROR: "+err.Error()+DIFF_MSG_END)
+				checkError(err)
+				return
 			}
-			return
-		}
-		if IS_AUTHORIZED_AS_ADMIN[m.Author.ID] { // if the user is authorized, proceed with the operation
-			_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+"+ /webassignroles ROLE UPDATE STARTED"+FIX_MSG_END)
+			_, err = s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+"+ /webassignroles ROLE UPDATE STARTED"+FIX_MSG_END)
 			if err != nil {
-				fmt.Println(err)
+				op.release()
+				checkError(err)
 				return
 			}
-			dangerousCommands.isInUse = true
-			dangerousCommands.session = s
-			dangerousCommands.AuthorID = m.Author.ID
-			dangerousCommands.ChannelID = m.ChannelID
-			dangerousCommands.cmdName = "/assignroles"
-			update_roles(s, m)                //testing new command
-			dangerousCommands.isInUse = false //reset the data so /assignroles can be used again
-			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"+ /webassignroles ROLE UPDATE COMPLETE"+DIFF_MSG_END)
+			err = update_roles(op.ctx, s, m)
+			outcome := command_outcome(err)
+			if op.ctx.Err() != nil {
+				outcome = "cancelled"
+			}
+			op.release() //free the lock so /webassignroles can be used again
+			record_command("/webassignroles", outcome)
 			if err != nil {
-				fmt.Println(err)
+				log_error("/webassignroles failed", err, command_fields(m))
+				_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /webassignroles ERROR: "+err.Error()+DIFF_MSG_END)
+				checkError(err)
 				return
 			}
-
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"+ /webassignroles ROLE UPDATE COMPLETE"+DIFF_MSG_END)
+			checkError(err)
 			return
 
 		} else {
-			_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /webassignroles ERROR: "+m.Author.Username+" IS NOT AUTHORIZED"+DIFF_MSG_END)
-			if err != nil {
-				fmt.Println(err)
-			}
+			send_not_authorized(s, m, "/webassignroles")
 		}
 	case "/test": // USE THIS COMMAND FOR TESTING
 		test(s, m)
 
 	case "/help":
 		_, err := s.ChannelMessageSend(m.ChannelID, "```ini\n"+AVAILABLE_COMMANDS+"\n```")
-		if err != nil {
-			fmt.Println(err)
-		}
+		checkError(err)
 	}
 
-	/* REMOVE THIS LATER, NO LONGER NEEDED?
-	if dangerousCommands.isInUse && dangerousCommands.AuthorID == m.Author.ID {
-		_, err := s.ChannelMessageSend(m.ChannelID, "[:sparkles:] Updating races! ")
-		if err != nil {
-			fmt.Println(err)
-		}
-		update_roles(s, m)              //testing
-		dangerousCommands.isInUse = false //reset the data so /assignroles can be used again
+	// Commands with arguments, each checks the permission level of its author
+	fields := strings.Fields(m.Content)
+	if len(fields) == 0 || !is_authorized(s, m, fields[0]) {
+		return
 	}
-	*/
-
-	if IS_PRIVILEGED_USER[m.Author.ID] || IS_AUTHORIZED_AS_ADMIN[m.Author.ID] {
-		// Lookup a player and show their information
-		if strings.Contains(m.Content, "/show") {
-			userInput := strings.TrimLeft(m.Content, "/show")
-			userInput = strings.TrimPrefix(userInput, " ")
-			userInput = strings.TrimSuffix(userInput, "\n")
-			userID := mapWebUserNameToWebUserId[userInput]
-			player := mapWebUserIdToPlayer[userID]
-
-			if mapDiscordIdExists[player.Discord_id] {
-				message := "**Web Name**: " + fmt.Sprintln(player.WebName)
-				message += "**Discord: ** " + "<@" + fmt.Sprintf(player.Discord_id) + ">\n"
-				//message += "**Known Discord Names: **" + fmt.Sprintln(player.DiscordName)
-				message += "**SnowflakeID: ** " + fmt.Sprintln(player.Discord_id)
-				_, err := s.ChannelMessageSend(m.ChannelID, message)
-				checkError(err)
-			} else {
-				_, err := s.ChannelMessageSend(m.ChannelID, userInput+" not found")
-				checkError(err)
-			}
+	switch fields[0] {
+	case "/team": // Manage the team registry
+		team_command(s, m)
+	case "/status": // Show or abort the dangerous command that is running
+		if m.Content == "/status" {
+			status_command(s, m)
+		}
+	case "/cancel":
+		if m.Content == "/cancel" {
+			cancel_command(s, m)
 		}
+	case "/snapshot": // Take, compare and restore snapshots of every member's roles
+		snapshot_command(s, m)
+	case "/audit": // Query the audit log
+		audit_command(s, m)
+	case "/link": // Manually bind or unbind a web player and a discord member
+		link_command(s, m)
+	case "/unlink":
+		unlink_command(s, m)
+	case "/perm": // Grant permission levels and change the level of commands
+		perm_command(s, m)
+	case "/show": // Lookup a player and show their information
+		show_command(s, m)
+	case "/myteam": // Roster, assistant coaches and announcements of the team a captain or coach leads
+		myteam_command(s, m)
 	}
 
 }
@@ -402,12 +490,47 @@ func messageSendWrapper(s *discordgo.Session, m *discordgo.MessageCreate, c stri
 	checkError(err)
 }
 
+// Sends a message to the staff channel, split into multiple messages if it is too long for discord
+func send_staff_message(s *discordgo.Session, message string) {
+	if STAFF_CHANNEL_ID == "" {
+		log_info("staff notice", log_fields{"message": message})
+		return
+	}
+	send_long_message(s, STAFF_CHANNEL_ID, message)
+}
+
+// Sends a message line by line in chunks that stay below discords message size limit
+func send_long_message(s *discordgo.Session, channelID string, message string) {
+	for _, chunk := range split_message(message) {
+		_, err := s.ChannelMessageSend(channelID, chunk)
+		checkError(err)
+	}
+}
+
+// Splits a message at line breaks into chunks that stay below discords message size limit
+func split_message(message string) []string {
+	const maxLen = 1900
+	var chunks []string
+	var chunk string
+	for _, line := range strings.SplitAfter(message, "\n") {
+		if len(chunk)+len(line) > maxLen && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk = ""
+		}
+		chunk += line
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
 // Test function executes with side effects and returns final message to be send
 func test(s *discordgo.Session, m *discordgo.MessageCreate) {
-	a := mapWebUserIdToPlayer[42]
+	a, _ := get_web_player(42)
 	s.ChannelMessageSend(m.ChannelID, a.WebName)
-	b := mapWebUserNameToWebUserId["Neblime"]
-	s.ChannelMessageSend(m.ChannelID, string(b))
+	b, _ := get_web_id_by_name("Neblime")
+	s.ChannelMessageSend(m.ChannelID, strconv.Itoa(b))
 }
 
 /* //testfunc old
@@ -470,39 +593,240 @@ func test(s *discordgo.Session, m *discordgo.MessageCreate) {
 }
 */
 
-func select_batch_to_delete(s *discordgo.Session, m *discordgo.MessageCreate) {
-	var batch string
-	for n, b := range mapBatchesOfCreatedRoles {
-		batch += n + ": "
-		for _, v := range b {
-			batch += fmt.Sprintf("\t<@%s> %s \n", v.Discord_id, v.Name)
+// Ask which batch (or which entries of a batch) to delete, confirm and delete them
+// The conversation holds op until it ends, returns false if there is nothing to select
+func start_deleteroles_conversation(s *discordgo.Session, m *discordgo.MessageCreate, op *operation_t) bool {
+	if count_role_batches() == 0 {
+		_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /deleteroles ERROR: no batches of created roles"+DIFF_MSG_END)
+		checkError(err)
+		return false
+	}
+
+	var batchName string
+	var selected []int // entry indexes, nil for the whole batch
+	pending := false   // handed op over to request_approval
+	c := new_conversation("/deleteroles", m.Author.ID, m.ChannelID,
+		conversation_step_t{
+			Name: "batch",
+			Kind: STEP_CHOICE,
+			Prompt: func() string {
+				var batches string
+				for _, n := range sorted_batch_names() {
+					batch, err := refresh_role_batch(s, n) // roles may have been deleted by hand since
+					if err != nil {
+						checkError(err)
+						batch, _ = get_role_batch(n)
+					}
+					batches += render_role_batch(batch) + "\n"
+				}
+				return FIX_MSG_START + "+ /deleteroles STARTING\n\nPlease choose the batch to delete from (or type its number):" + FIX_MSG_END + "\n" + batches
+			},
+			Options: func() []conversation_option_t {
+				var options []conversation_option_t
+				for _, n := range sorted_batch_names() {
+					batch, _ := get_role_batch(n)
+					options = append(options, conversation_option_t{
+						Label:       "Batch " + batch.Name,
+						Value:       batch.Name,
+						Description: fmt.Sprintf("%s, %d entries, %s", batch.Source, len(batch.Teams), batch.Created_at.Format("2006-01-02")),
+					})
+				}
+				return options
+			},
+			Answer: func(input string) (string, error) {
+				batchName = input
+				if batch, _ := get_role_batch(batchName); len(batch.Teams) == 1 {
+					return "confirm", nil
+				}
+				return "entries", nil
+			},
+		},
+		conversation_step_t{
+			Name: "entries",
+			Kind: STEP_MULTI,
+			Prompt: func() string {
+				return FIX_MSG_START + "Choose the entries of batch " + batchName + " to delete (or type them, e.g. 2,3 or all):" + FIX_MSG_END
+			},
+			Options: func() []conversation_option_t {
+				options := []conversation_option_t{{Label: "All entries", Value: "all"}}
+				batch, _ := get_role_batch(batchName)
+				for i, t := range batch.Teams {
+					options = append(options, conversation_option_t{Label: fmt.Sprintf("%d. %s", i+1, t.Name), Value: strconv.Itoa(i + 1)})
+				}
+				return options
+			},
+			Answer: func(input string) (string, error) {
+				selected = nil
+				chosen := make(map[int]bool)
+				for _, value := range strings.Split(input, ",") {
+					if value == "all" {
+						selected = nil
+						break
+					}
+					n, _ := strconv.Atoi(value)
+					if !chosen[n-1] { // "2,2" deletes entry 2 once
+						chosen[n-1] = true
+						selected = append(selected, n-1)
+					}
+				}
+				return "confirm", nil
+			},
+		},
+		conversation_step_t{
+			Name: "confirm",
+			Kind: STEP_CONFIRM,
+			Prompt: func() string {
+				batch, _ := get_role_batch(batchName)
+				count := len(batch.Teams)
+				if selected != nil { // entries may have been deleted since they were chosen
+					var existing []int
+					for _, i := range selected {
+						if i >= 0 && i < len(batch.Teams) {
+							existing = append(existing, i)
+						}
+					}
+					selected = append([]int{}, existing...)
+					count = len(selected)
+				}
+				return FIX_MSG_START + fmt.Sprintf("Delete %d roles and their channels from batch %s?", count, batchName) + FIX_MSG_END
+			},
+			Answer: func(string) (string, error) {
+				count := len(selected)
+				if selected == nil {
+					batch, _ := get_role_batch(batchName)
+					count = len(batch.Teams)
+				}
+				summary := fmt.Sprintf("delete %d roles and their channels from batch %s", count, batchName)
+				var err error
+				pending, err = request_approval(s, op, summary, func() {
+					deleteroles(op.ctx, s, m.ChannelID, m.Author.ID, batchName, selected) // run role deletion
+				})
+				return "", err
+			},
+		},
+	)
+	c.Ctx = op.ctx
+	c.OnEnd = func(string) {
+		if !pending {
+			op.release()
 		}
-		batch += "\n"
 	}
-	_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+"+ /deleteroles STARTING\n\nPlease enter batchnumber of roles to be deleted from below:\n\n"+FIX_MSG_END+batch)
-	checkError(err)
+	start_conversation(s, c)
+	return true
 }
 
-// Delete all roles that were created by Starbot since the bot started running
-func deleteroles(s *discordgo.Session, m *discordgo.MessageCreate, batchName string) {
-	_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+"+ /deleteroles DELETING ROLES\n"+FIX_MSG_END)
+// Delete the selected entries of a batch (all of them if selected is nil)
+// Roles and channels that are already gone are skipped, they never make the deletion fail
+// Stops before the next entry when ctx is cancelled, entries that weren't deleted stay in the batch
+func deleteroles(ctx context.Context, s *discordgo.Session, channelID string, authorID string, batchName string, selected []int) {
+	_, err := s.ChannelMessageSend(channelID, FIX_MSG_START+"+ /deleteroles DELETING ROLES\n"+FIX_MSG_END)
 	checkError(err)
 
-	//delete each role in the provided batch
-	for _, b := range mapBatchesOfCreatedRoles[batchName] {
-		cordMessage := fmt.Sprintf("> Deleting %s <@%s>\n", b.Name, b.Discord_id)
-		_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
+	batch, err := refresh_role_batch(s, batchName)
+	if err != nil {
 		checkError(err)
-		err = s.GuildRoleDelete(m.GuildID, b.Discord_id)
+		batch, _ = get_role_batch(batchName)
+	}
+	selection := "batch " + batchName
+	if selected == nil {
+		for i := range batch.Teams {
+			selected = append(selected, i)
+		}
+	} else {
+		var entries []string
+		for _, i := range selected {
+			entries = append(entries, strconv.Itoa(i+1))
+		}
+		selection += " entries " + strings.Join(entries, ",")
+	}
+	isSelected := make(map[int]bool)
+	for _, i := range selected {
+		isSelected[i] = true
+	}
+
+	//delete each selected entry of the batch, keep the rest
+	var remaining []team_t
+	var deleted, gone, failed int
+	audit := func(action string, b team_t, result string) {
+		append_audit_log(audit_entry_t{
+			Actor:     authorID,
+			Command:   "/deleteroles",
+			Arguments: selection,
+			Action:    action,
+			Target:    fmt.Sprintf("%s (%s) from batch %s", b.Name, b.Discord_id, batchName),
+			Result:    result,
+		})
+	}
+	for i, b := range batch.Teams {
+		if !isSelected[i] || ctx.Err() != nil {
+			remaining = append(remaining, b)
+			continue
+		}
+		cordMessage := fmt.Sprintf("> Deleting %s <@&%s>\n", b.Name, b.Discord_id)
+		if b.Channels_only {
+			cordMessage = fmt.Sprintf("> Deleting the channels of %s\n", b.Name)
+		} else if !b.Exists {
+			cordMessage = fmt.Sprintf("> %s was already removed\n", b.Name)
+		}
+		left, channelErrs := delete_team_channels(s, b)
+		for _, err = range channelErrs {
+			checkError(err)
+			failed++
+		}
+		if len(channelErrs) > 0 { // keep the entry with the channels that are left, the role goes once they are gone
+			audit("channels_delete", b, audit_result(channelErrs[0]))
+			remaining = append(remaining, left)
+			_, err = s.ChannelMessageSend(channelID, fmt.Sprintf("> Couldn't delete all channels of %s: %s\n", b.Name, channelErrs[0].Error()))
+			checkError(err)
+			continue
+		} else if b.Category_id != "" || b.Text_channel_id != "" || b.Voice_channel_id != "" {
+			audit("channels_delete", b, "ok")
+		}
+		if b.Channels_only {
+			forget_team_channels(b.Discord_id)
+		} else {
+			if b.Exists {
+				err = s.GuildRoleDelete(DISCORD_SERVER_ID, b.Discord_id)
+				if err != nil && !is_not_found(err) {
+					checkError(err)
+					cordMessage = fmt.Sprintf("> Couldn't delete %s: %s\n", b.Name, err.Error())
+					audit("role_delete", b, audit_result(err))
+					failed++
+					remaining = append(remaining, b)
+					_, err = s.ChannelMessageSend(channelID, cordMessage)
+					checkError(err)
+					continue
+				}
+				deleted++
+				audit("role_delete", b, "ok")
+			} else {
+				gone++
+				audit("role_delete", b, "already removed")
+			}
+			unregister_team_role(b.Discord_id)
+		}
+		_, err = s.ChannelMessageSend(channelID, cordMessage)
 		checkError(err)
 	}
 
 	// Cleanup and finish
-	delete(mapBatchesOfCreatedRoles, batchName)
-	reset_dangerous_commands_status()
-	store_data(mapBatchesOfCreatedRoles, "mapBatchesOfCreatedRoles")
+	set_role_batch_teams(batchName, remaining)
 
-	_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"+ /deleteroles DONE"+DIFF_MSG_END)
+	outcome := "ok"
+	if failed > 0 {
+		outcome = "error"
+	} else if ctx.Err() != nil {
+		outcome = "cancelled"
+	}
+	record_command("/deleteroles", outcome)
+	summary := fmt.Sprintf("+ /deleteroles DONE\n+ %d roles deleted, %d were already removed", deleted, gone)
+	if failed > 0 {
+		summary += fmt.Sprintf("\n- %d deletions failed, the roles and channels that could not be deleted stay in batch %s", failed, batchName)
+	}
+	if ctx.Err() != nil {
+		summary += fmt.Sprintf("\n- CANCELLED, the entries that weren't deleted stay in batch %s", batchName)
+	}
+	_, err = s.ChannelMessageSend(channelID, DIFF_MSG_START+summary+DIFF_MSG_END)
 	checkError(err)
 }
 
@@ -510,27 +834,24 @@ func deleteroles(s *discordgo.Session, m *discordgo.MessageCreate, batchName str
 // see: https://developers.google.com/sheets/api/guides/concepts
 //func get_sheet_state(players map[string]user_t, disRoles_m map[string]*discordgo.Role) map[string]user_t {
 // Check google sheet and assign roles automatically (create new team roles as needed)
-func update_roles(dg *discordgo.Session, m *discordgo.MessageCreate) {
+func update_roles(ctx context.Context, dg *discordgo.Session, m *discordgo.MessageCreate) error {
 	// 0. Get all the roles from the discord and make a map
 	discordRoles, err := dg.GuildRoles(DISCORD_SERVER_ID)
-	checkError(err)
+	if err != nil {
+		return fmt.Errorf("could not load the roles: %w", err)
+	}
 	roles_m := make(map[string]*discordgo.Role)
 	for _, b := range discordRoles {
 		roles_m[b.Name] = b
 	}
 
 	// 1. Get all the users in the discord
-	discordUsers, err := dg.GuildMembers(DISCORD_SERVER_ID, "", 1000)
-	checkError(err)
-
-	// 2. Create map of username#discriminator to discord_id
-	// and also a map of discord_id -> bool to check if they exist
-	//mapDiscordNameToCordID := make(map[string]string)
-	//mapDiscordIdExists := make(map[string]bool)
-	for _, u := range discordUsers {
-		mapDiscordNameToCordID[u.User.String()] = u.User.ID
-		mapDiscordIdExists[u.User.ID] = true
+	// 2. and rebuild the map of username#discriminator to discord_id and discord_id -> bool to check if they exist
+	_, err = get_guild_members(dg)
+	if err != nil {
+		return fmt.Errorf("could not load the members: %w", err)
 	}
+
 	// used to check if a role by name already exists: if mapExistingDiscordRoles[rolename] {...}
 	for _, b := range discordRoles {
 		mapExistingDiscordRoles[b.Name] = true
@@ -540,35 +861,39 @@ func update_roles(dg *discordgo.Session, m *discordgo.MessageCreate) {
 	#### */
 	// 3. Get desired state of roles from google sheets
 
-	// Read the secret file (google api key to access google sheets)
-	data, err := ioutil.ReadFile("./keys/secret.json")
-	checkError(err)
 	// Create oAuth client for google sheets
-	conf, err := google.JWTConfigFromJSON(data, sheets.SpreadsheetsScope)
-	checkError(err)
-	client := conf.Client(context.TODO())
-	srv, err := sheets.New(client)
-	checkError(err)
+	srv, err := get_sheets_service()
+	if err != nil {
+		return fmt.Errorf("could not connect to google sheets: %w", err)
+	}
 
 	// Read sheet name cells from spreadsheet
 	target_screen_names := "Player List" + "!A1:A"
 	screenNameResp, err := srv.Spreadsheets.Values.Get(SPREADSHEET_ID, target_screen_names).Do()
-	checkError(err)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", target_screen_names, err)
+	}
 
 	// Read discord name cells from spreadsheet
 	target_discord_names := "Player List" + "!B1:B"
 	discord_nameResp, err := srv.Spreadsheets.Values.Get(SPREADSHEET_ID, target_discord_names).Do()
-	checkError(err)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", target_discord_names, err)
+	}
 
 	// Read race cells from spreadsheet
 	target_ingame_race := "Player List" + "!E1:E"
 	ingameRaceResp, err := srv.Spreadsheets.Values.Get(SPREADSHEET_ID, target_ingame_race).Do()
-	checkError(err)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", target_ingame_race, err)
+	}
 
 	// Read group cells from spreadsheet
 	target_group := "Player List" + "!C1:C"
 	groupResp, err := srv.Spreadsheets.Values.Get(SPREADSHEET_ID, target_group).Do()
-	checkError(err)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", target_group, err)
+	}
 
 	//Read player tier from.. teams sheet
 	//target_group := "Player List" + "!C1:C"
@@ -628,15 +953,15 @@ func update_roles(dg *discordgo.Session, m *discordgo.MessageCreate) {
 	targetTeams := "Teams" + "!A1:Z" // defines the sheet and range to be read
 	resp, err := srv.Spreadsheets.Values.Get(SPREADSHEET_ID, targetTeams).Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve data from sheet: %v", err)
+		return fmt.Errorf("could not read %s: %w", targetTeams, err)
+	}
+	if len(resp.Values) == 0 {
+		return fmt.Errorf("%s is empty", targetTeams)
 	}
 
 	// 1. Let's make a list of the teams
 	teams_a := resp.Values[0]
 
-	// [teamname].struct that holds various info such as the discord ID, the players
-	sheetTeams := make(map[string]team_t)
-
 	sheetsTeamList := make([]string, 0)
 	// Extract the team names and put into the list
 	for _, b := range teams_a {
@@ -645,10 +970,6 @@ func update_roles(dg *discordgo.Session, m *discordgo.MessageCreate) {
 			continue
 		} else {
 			sheetsTeamList = append(sheetsTeamList, x)
-			sheetTeams[x] = team_t{
-				Exists: true,
-				Name:   x,
-			}
 		}
 	}
 
@@ -725,256 +1046,149 @@ func update_roles(dg *discordgo.Session, m *discordgo.MessageCreate) {
 		}
 
 	}
-	checkError(err)
 
-	// 4. Check if the user from sheet have desired roles assigned
-	// and if not -> assign it!
-
-	for screen_name, _ := range sheetPlayers {
+	if ctx.Err() != nil {
+		return fmt.Errorf("cancelled before changing anything")
+	}
 
-		//get the discordname and the discorduser id for the player we're on in the loop
-		cordName := sheetPlayers[screen_name].Discord_name
-		cordUserid := mapDiscordNameToCordID[cordName]
+	// Safety net, /snapshot restore puts every member's roles back to how they were before this run
+	snapshot, err := create_role_snapshot(dg, "starbot", "before /webassignroles")
+	if err != nil {
+		return fmt.Errorf("could not take a role snapshot: %w", err)
+	}
+	_, err = dg.ChannelMessageSend(m.ChannelID, "> Took role snapshot "+snapshot.Id+" before changing anything")
+	checkError(err)
 
-		// Check if the user even exists on the server
-		if !mapDiscordIdExists[cordUserid] {
-			continue // skip if the user doesn't exist
+	// New team roles and their channels are recorded as a batch, so /deleteroles can roll them back
+	var failedTeams []string
+	batch := new_role_batch("/webassignroles", m.Author.ID, sheet_revision(screenNameResp, discord_nameResp, ingameRaceResp, groupResp, resp))
+	for _, n := range sheetsTeamList {
+		if ctx.Err() != nil {
+			break
 		}
-
-		// Assign Coach/Assistant Coach/ Player
-		group_name := ""
-		didAssignGroupRole := false // set to true if we assigned Coach, Assistant Coach, or Player role.
-		wishGroup := sheetPlayers[screen_name].Group
-		switch wishGroup {
-		case PLAYER:
-			group_name = "Player"
-			// don't try to assign player role since we don't have it anymore
-			//err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, PLAYER_ROLE_ID)
-			//checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, COACH_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, ASST_COACH_ROLE_ID)
-			checkError(err)
-			didAssignGroupRole = true
-		case COACHES:
-			group_name = "Coach"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, COACH_ROLE_ID)
-			checkError(err)
-			//err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, PLAYER_ROLE_ID) //no longer needed
-			//checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, ASST_COACH_ROLE_ID)
-			checkError(err)
-			didAssignGroupRole = true
-		case ASSISTANTCOACH:
-			group_name = "Assistant Coach"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, ASST_COACH_ROLE_ID)
-			checkError(err)
-			//err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, PLAYER_ROLE_ID) //no longer needed
-			//checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, COACH_ROLE_ID)
-			checkError(err)
-			didAssignGroupRole = true
+		if _, registered := resolve_team(n); registered {
+			continue
 		}
-
-		if didAssignGroupRole {
-			cordMessage1 := fmt.Sprintf("> Assigned <@%s> %s to %s\n", cordUserid, screen_name, group_name)
-			_, err = dg.ChannelMessageSend(m.ChannelID, cordMessage1)
-			checkError(err)
-			didAssignGroupRole = false
+		if role, exists := roles_m[n]; exists { // role was made by hand, adopt it into the team registry
+			register_team(registered_team_t{Name: n, Role_id: role.ID, Color: role.Color, Season: current_season(), Created_by: m.Author.ID, Created_at: time.Now().UTC()})
+			continue
 		}
-
-		// Assign Zerg/Terran/Protoss
-		race_name := ""
-		didAssignRaceRole := false // set to true if we assigned Zerg, Terran, or Protoss role.
-		wishRace := sheetPlayers[screen_name].Race
-		switch wishRace {
-		case "Zerg":
-			race_name = "Zerg"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, ZERG_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TERRAN_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, PROTOSS_ROLE_ID)
-			checkError(err)
-			didAssignRaceRole = true
-
-		case "Terran":
-			race_name = "Terran"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, TERRAN_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, PROTOSS_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, ZERG_ROLE_ID)
-			checkError(err)
-			didAssignRaceRole = true
-
-		case "Protoss":
-			race_name = "Protoss"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, PROTOSS_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TERRAN_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, ZERG_ROLE_ID)
+		// create the role and register the team
+		registeredTeam, err := create_team(dg, n, NEON_GREEN, m.Author.ID)
+		if err != nil {
+			log_error("could not create team role", err, log_fields{"command": "/webassignroles", "guild": DISCORD_SERVER_ID, "team": n})
+			failedTeams = append(failedTeams, n)
+			_, err = dg.ChannelMessageSend(m.ChannelID, "> Couldn't create team role "+n)
 			checkError(err)
-			didAssignRaceRole = true
-
+			continue
 		}
-		if didAssignRaceRole {
-			cordMessage2 := fmt.Sprintf("> Assigned <@%s> %s to %s\n", cordUserid, screen_name, race_name)
-			_, err = dg.ChannelMessageSend(m.ChannelID, cordMessage2)
-			checkError(err)
-			didAssignRaceRole = false
+		cordMessage3 := fmt.Sprintf("> Created <@&%s>\n", registeredTeam.Role_id)
+		if staffErr := check_staff_role(); staffErr != nil {
+			cordMessage3 += "> Created no channels for " + n + ", " + staffErr.Error() + "\n"
+		} else if err = provision_team(dg, &registeredTeam); err != nil {
+			log_error("could not create team channels", err, log_fields{"command": "/webassignroles", "guild": DISCORD_SERVER_ID, "role": registeredTeam.Role_id})
+			failedTeams = append(failedTeams, n)
+			cordMessage3 += "> Couldn't create all channels of " + n + "\n"
 		}
+		batch.Teams = append(batch.Teams, batch_entry(registeredTeam, false))
+		append_audit_log(audit_entry_t{Actor: m.Author.ID, Command: "/webassignroles", Action: "team_create", Target: fmt.Sprintf("%s (%s) in batch %s", n, registeredTeam.Role_id, batch.Name), Result: audit_result(err)})
 
-		// Assign correct tier
-		tier_name := "Tier 0"
-		didAssignTier := false
-		wishTier := sheetPlayers[screen_name].Tier
-		switch wishTier {
-		case TIER0:
-			tier_name = "Tier 0"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, TIER0_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER1_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER3_ROLE_ID)
-			checkError(err)
-			didAssignTier = true
-		case TIER1:
-			tier_name = "Tier 1"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, TIER1_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER0_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER3_ROLE_ID)
-			checkError(err)
-			didAssignTier = true
-		case TIER2:
-			tier_name = "Tier 2"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, TIER2_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER1_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER3_ROLE_ID)
-			checkError(err)
-			didAssignTier = true
-		case TIER3:
-			tier_name = "Tier 3"
-			err := dg.GuildMemberRoleAdd(DISCORD_SERVER_ID, cordUserid, TIER3_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER1_ROLE_ID)
-			checkError(err)
-			err = dg.GuildMemberRoleRemove(DISCORD_SERVER_ID, cordUserid, TIER2_ROLE_ID)
-			checkError(err)
-			didAssignTier = true
-		}
-		if didAssignTier {
-			cordMessage2 := fmt.Sprintf("> Assigned <@%s> %s to %s\n", cordUserid, screen_name, tier_name)
-			_, err = dg.ChannelMessageSend(m.ChannelID, cordMessage2)
-			checkError(err)
-			didAssignRaceRole = false
-		}
+		_, err = dg.ChannelMessageSend(m.ChannelID, cordMessage3)
+		checkError(err)
+	}
+	// Persist the newly created roles on disc
+	if len(batch.Teams) > 0 {
+		record_batch(batch)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("cancelled after setting up %d new teams, snapshot %s has the roles from before", len(batch.Teams), snapshot.Id)
 	}
 
-	//FIXME: If we manually delete a role that was auto created by Starbot and then try to run more commands
-	// suc as deleteroles, it crashes and it seems to happen here!
-	// my guess is that it has to do with reading something from one of the global data structures and using that
-	// with a call to a func from discordgo and that breaks since the entry is no langer valid due to the manual edit
-	created_new_role := false
-	for _, n := range sheetsTeamList {
-		if mapExistingDiscordRoles[n] {
+	// 4. Check if the users from the sheet have the desired roles assigned
+	// and if not -> assign them, members are handled in parallel
+	var jobs []role_job_t
+	var reports []member_report_t
+	var assignedMutex sync.Mutex
+	for screen_name, usr := range sheetPlayers {
+		usr.Discord_id = discord_id_by_name(usr.Discord_name)
+		if !usr.exists() { // Skip the user if they are not on the server
+			reports = append(reports, member_report_t{Name: screen_name, Status: "skipped", Error: usr.Discord_name + " not found on the server"})
 			continue
-		} else {
-			if !created_new_role { // Creat a new batch for the teams we are about to create
-				var newTeams []team_t
-				NEW_BATCH_NAME = get_batch_name(mapBatchesOfCreatedRoles)
-				mapBatchesOfCreatedRoles[NEW_BATCH_NAME] = newTeams
-				created_new_role = true
-			}
-			entry := mapBatchesOfCreatedRoles[NEW_BATCH_NAME]
-			var nTeam team_t
-			// create the role
-			new_role, err := dg.GuildRoleCreate(m.GuildID)
-			checkError(err)
-			nTeam.Discord_id = new_role.ID
-			nTeam.Name = n
-			nTeam.Exists = true
-
-			// name the role correctly
-			new_role, err = dg.GuildRoleEdit(m.GuildID, new_role.ID, n, NEON_GREEN, false, 0, true)
-			checkError(err)
-			entry = append(entry, nTeam)
-
-			//update the map of roles
-			roles_m[n] = new_role
-			mapBatchesOfCreatedRoles[NEW_BATCH_NAME] = entry // save the update to the map
-
-			cordMessage3 := fmt.Sprintf("> Created %s\n", new_role.Mention())
-			_, err = dg.ChannelMessageSend(m.ChannelID, cordMessage3)
 		}
+		user := usr
+		desired := sheet_user_roles(user)
+		jobs = append(jobs, role_job_t{
+			Name:      screen_name,
+			DiscordId: user.Discord_id,
+			Run: func() ([]string, error) {
+				changes, err := apply_member_roles(dg, user.Discord_id, desired)
+				if team, ok := resolve_team(user.Team); ok && err == nil {
+					// save that we assigned the team role so we can unassign it later
+					assignedMutex.Lock()
+					newlyAssignedRoles = append(newlyAssignedRoles, [2]string{user.Discord_id, team.Role_id})
+					assignedMutex.Unlock()
+				}
+				return changes, err
+			},
+		})
 	}
-	// Persist the newly created roles on disc
-	// TO DO
-	if created_new_role {
-		fmt.Println("TODO: persist data on disk")
-		store_data(mapBatchesOfCreatedRoles, "mapBatchesOfCreatedRoles")
-		//load_data(&mapBatchesOfCreatedRoles, "mapBatchesOfCreatedRoles")
-	}
-
-	// Copy user info into the sheetTeams map
-	for _, usr := range sheetPlayers {
-		team := usr.Team
-		if len(team) == 0 {
-			continue //skip ahead if no team was found
-		}
-		// write the data to the sheetTeams map so we can use it in the next code block
-		entry := sheetTeams[team]
-
-		//make sure in the updated entry we have the userid, we need it in thext next loop
-		usr.Discord_id = mapDiscordNameToCordID[usr.Discord_name]
-		entry.Members = append(entry.Members, usr)
-
-		sheetTeams[team] = entry //write the entry
+	reports = append(reports, run_role_jobs(ctx, dg, m.ChannelID, m.Author.ID, "/webassignroles", jobs)...)
+	send_role_report(dg, m.ChannelID, "/webassignroles", "", reports)
+
+	failed := count_reports(reports)["failed"]
+	switch {
+	case len(failedTeams) > 0:
+		return fmt.Errorf("could not set up %s, %d members failed", strings.Join(failedTeams, ", "), failed)
+	case failed > 0:
+		return fmt.Errorf("%d of %d members failed, see the report", failed, len(jobs))
 	}
+	return nil
+}
 
-	// iterate over all teams and assign the teamrole to the members
-	for _, t := range sheetTeams { //for each team in the spreadsheet
-		for _, usr := range t.Members { //for each user in the current team
-
-			if usr.exists() == false { // Skip to the next user if the user is not on the server
-				_, err = dg.ChannelMessageSend(m.ChannelID, "> "+usr.Discord_name+" not found on the server")
-				fmt.Println("ERROR:", usr.Discord_name, "not found on the server.")
-				continue
-			}
+// Returns the roles a member from the sheet should (true) and should not (false) have
+// Team roles are only added, the sheet doesn't tell us which teams a member left
+func sheet_user_roles(usr user_t) map[string]bool {
+	desired := make(map[string]bool)
+
+	// Coach/Assistant Coach/Player
+	switch usr.Group {
+	case PLAYER:
+		desired[COACH_ROLE_ID] = false
+		desired[ASST_COACH_ROLE_ID] = false
+	case COACHES:
+		desired[COACH_ROLE_ID] = true
+		desired[ASST_COACH_ROLE_ID] = false
+	case ASSISTANTCOACH:
+		desired[ASST_COACH_ROLE_ID] = true
+		desired[COACH_ROLE_ID] = false
+	}
 
-			id := usr.Discord_id
-			team := usr.Team
-			team_id := roles_m[team]
+	// Zerg/Terran/Protoss
+	raceRoles := map[string]string{"Zerg": ZERG_ROLE_ID, "Terran": TERRAN_ROLE_ID, "Protoss": PROTOSS_ROLE_ID}
+	if wishRole, ok := raceRoles[usr.Race]; ok {
+		for _, roleID := range raceRoles {
+			desired[roleID] = roleID == wishRole
+		}
+	}
 
-			err = nil
-			err = dg.GuildMemberRoleAdd(m.GuildID, id, team_id.ID)
-			checkError(err)
-			if err == nil { //if we did actually assign the role, save that we did that so we can unassign it later
-				// add the role to current member
-				var assignment [2]string
-				assignment[0] = id
-				assignment[1] = team_id.ID
-				newlyAssignedRoles = append(newlyAssignedRoles, assignment)
-				// send discord message about the role assignment
-				cordUser, err := dg.GuildMember(DISCORD_SERVER_ID, id)
-				checkError(err)
-				cordMessage := fmt.Sprintf("> Assigned %s to %s\n", cordUser.Mention(), roles_m[team].Mention())
-				_, err = dg.ChannelMessageSend(m.ChannelID, cordMessage)
-			}
+	// Tier
+	tierRoles := map[int]string{TIER0: TIER0_ROLE_ID, TIER1: TIER1_ROLE_ID, TIER2: TIER2_ROLE_ID, TIER3: TIER3_ROLE_ID}
+	if wishRole, ok := tierRoles[usr.Tier]; ok {
+		for _, roleID := range tierRoles {
+			desired[roleID] = roleID == wishRole
 		}
+	}
 
+	// Team
+	if team, ok := resolve_team(usr.Team); ok {
+		desired[team.Role_id] = true
 	}
+	return desired
 }
 
 // Helper that returns true if the user is found on the discord server
 func (user user_t) exists() bool {
-	discordid := mapDiscordNameToCordID[user.Discord_name]
-	return mapDiscordIdExists[discordid]
+	return discord_id_exists(discord_id_by_name(user.Discord_name))
 }
 
 /* Todo: I haven't decided what kind of maps I want to store that hold the information required
@@ -995,7 +1209,7 @@ func (u user_t) get_team() team_t {
 }
 
 // Returns correct batchnumber as string for the new batch
-func get_batch_name(m map[string][]team_t) string {
+func get_batch_name(m map[string]role_batch_t) string {
 
 	for i := 0; i <= len(m); i++ {
 		num := strconv.Itoa(i)
@@ -1006,27 +1220,6 @@ func get_batch_name(m map[string][]team_t) string {
 	return "-1" //this should never happen
 }
 
-func reset_dangerous_commands_status() {
-	dangerousCommands.isInUse = false
-	dangerousCommands.cmdName = ""
-	dangerousCommands.AuthorID = ""
-}
-
-// Returns true if the user input can be mapped to a batch of auto created roles from mapBatchesOfCreatedRoles
-func deleteroles_check_input(userMessage string) bool {
-	_, err := strconv.Atoi(userMessage)
-	if err != nil { //Looks like it isn't a number
-		reset_dangerous_commands_status()
-		return false
-	}
-	//check if the input is within the bounds of existing batches
-	if _, exists := mapBatchesOfCreatedRoles[userMessage]; exists {
-		reset_dangerous_commands_status()
-		return true
-	}
-	return false
-}
-
 func parse_match_result(user_input string, sess *discordgo.Session, m *discordgo.MessageCreate) string {
 	var message string //this will be returned and sent to discord every time a users posts a report
 	var error_message string
@@ -1089,7 +1282,7 @@ func parse_match_result(user_input string, sess *discordgo.Session, m *discordgo
 					p2s_i, err := strconv.Atoi(player_two_score)
 					if err != nil {
 						error_message += "```diff\n- REJECTED: Formatting error\n\nYour input:\n" + s + "\n\nCorrect format:\n" + MATCH_REPORT_FORMAT_HELP_TEXT
-						fmt.Println(err)
+						log_debug("match report score is not a number", log_fields{"error": err})
 						log_match_accepted(s, false) //log the match in logfile and print to stdout
 						sess.ChannelMessageDelete(MATCH_REPORTING_CHANNEL_ID, m.ID)
 						return error_message
@@ -1135,19 +1328,20 @@ func parse_match_result(user_input string, sess *discordgo.Session, m *discordgo
 
 // Log everything
 func log_message(s string) {
-	log.Println("[log-all]       " + s + "<br>\n")
+	reportLog.Println("[log-all]       " + s + "<br>\n")
 }
 
-// Log match to index.html and stdout
+// Log match to the public report (log.html) and the operational log
 // call with True to log accepted, and False to log rejected
 func log_match_accepted(s string, accepted bool) {
 	if accepted {
-		log.Println("[ACCEPTED] " + s + "<br>\n")
-		fmt.Println("[ACCEPTED] " + s)
+		reportLog.Println("[ACCEPTED] " + s + "<br>\n")
+		metricMatchReports.inc("accepted")
 	} else {
-		log.Println("[REJECTED] " + s + "<br>\n")
-		fmt.Println("[REJECTED] " + s)
+		reportLog.Println("[REJECTED] " + s + "<br>\n")
+		metricMatchReports.inc("rejected")
 	}
+	log_info("match report", log_fields{"accepted": accepted, "report": s})
 }
 
 // Load persistent data into memory
@@ -1174,112 +1368,139 @@ func load_persistent_internal_data_structures() {
 	load_data(&mapWebUserIdToPlayer, "mapWebUserIdToPlayer")
 	load_data(&mapDiscordNameToCordID, "mapDiscordNameToCordId")
 	load_data(&mapDiscordIdExists, "mapDiscordIdExists")
-	load_data(&mapBatchesOfCreatedRoles, "mapBatchesOfCreatedRoles")
+	load_data(&mapRoleBatches, "mapRoleBatches")
+	migrate_legacy_batches()
+	load_data(&webappCache, "webappCache")
+	load_data(&mapDiscordIdToIdentity, "mapDiscordIdToIdentity")
+	load_data(&mapDiscordIdToNameHistory, "mapDiscordIdToNameHistory")
+	load_data(&mapMatchReviews, "mapMatchReviews")
+	load_data(&mapMatchDecisions, "mapMatchDecisions")
+	load_data(&mapManualLinks, "mapManualLinks")
+	load_data(&oauthLinkRequests, "oauthLinkRequests")
+	load_data(&mapTeamRegistry, "mapTeamRegistry")
+	load_data(&mapUserPermissions, "mapUserPermissions")
+	load_data(&mapRolePermissions, "mapRolePermissions")
+	load_data(&mapCommandPermissions, "mapCommandPermissions")
+	load_data(&mapAssistantCoaches, "mapAssistantCoaches")
+	seed_team_registry()
 }
 
 // persist data structures on disc in ./data (data folder must be present in directory)
-func store_data(data interface{}, filename string) {
+// The error is logged as well, so callers that can't do anything about it may ignore it
+func store_data(data interface{}, filename string) error {
 	buffer := new(bytes.Buffer)
 	encoder := gob.NewEncoder(buffer)
 	err := encoder.Encode(data)
-	checkError(err)
-	err = ioutil.WriteFile("./data/"+filename, buffer.Bytes(), 0600)
-	checkError(err)
+	if err == nil {
+		err = ioutil.WriteFile("./data/"+filename, buffer.Bytes(), 0600)
+	}
+	if err != nil {
+		log_error("could not store data", err, log_fields{"file": filename})
+	}
+	return err
 }
 
 // load data that was stored on disc in ./data (data folder must be present in directory)
 func load_data(data interface{}, filename string) {
 	raw, err := ioutil.ReadFile("./data/" + filename)
-	checkError(err)
+	if os.IsNotExist(err) { // nothing stored yet
+		log_debug("no stored data", log_fields{"file": filename})
+		return
+	}
+	if err != nil {
+		log_error("could not load data", err, log_fields{"file": filename})
+		return
+	}
 	buffer := bytes.NewBuffer(raw)
 	dec := gob.NewDecoder(buffer)
 	err = dec.Decode(data)
-	checkError(err)
+	if err != nil {
+		log_error("could not decode data", err, log_fields{"file": filename})
+	}
 }
 
 // Get unique discord IDs for all players on web and save them -> output if we can't find players
-func scan_web_players(s *discordgo.Session, m *discordgo.MessageCreate) {
+// Returns an error if the scan couldn't run or its results couldn't be stored
+// Stops early once ctx is cancelled (/cancel or the lock expired), the players found until then are stored
+func scan_web_players(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) error {
 	var found int
 	var missing int
 	var misspelled int
-	// 1. Get all the users in the discord
-	discordUsers1, err := s.GuildMembers(DISCORD_SERVER_ID, "", 1000)
-	checkError(err)
-
-	discordUsers = append(discordUsers, discordUsers1...)
-	// TODO: we should check to make sure we automatically always send the right requests
-	// Since the server has more than 1k members we have to request 2 batches of 1000 each
-	if len(discordUsers) > 999 { //only request another batch if there are a lot of users
-		lasti := len(discordUsers) - 1 //index of last mmember in slice
-		discordUsers2, err := s.GuildMembers(DISCORD_SERVER_ID, discordUsers[lasti].User.ID, 1000)
-		checkError(err)
-		//combine both into mega slice
-		discordUsers = append(discordUsers, discordUsers2...)
-	}
-
-	// 2. Create map of username#discriminator to discord_id
-	for _, u := range discordUsers {
-		mapDiscordNameToCordID[u.User.String()] = u.User.ID
-		mapDiscordIdExists[u.User.ID] = true
+	var review int
+	var linked []audit_entry_t // accounts that changed, audited once the roster is stored
+	recordLink := func(player web_player_t, discordId string) {
+		if player.Discord_id == discordId {
+			return
+		}
+		linked = append(linked, audit_entry_t{
+			Actor:   m.Author.ID,
+			Command: "/scan_users",
+			Action:  "link",
+			Target:  fmt.Sprintf("%s (%d)", player.WebName, player.WebUserId),
+			Before:  player.Discord_id,
+			After:   discordId,
+		})
 	}
-
-	// ioutil deprecated but still works (io wrappers)
-	data_from_players_file, err := ioutil.ReadFile("./data/players.json")
+	// 1. Get all the users in the discord
+	// 2. and create map of username#discriminator to discord_id
+	var err error
+	members, err := get_guild_members(s)
 	if err != nil {
-		fmt.Println("error: ", err)
-		return
+		return fmt.Errorf("could not load the members: %w", err)
 	}
 
-	// put json data into slice of players
-	playersUnmarsh := make([]web_player_t, len(data_from_players_file))
-	err = json.Unmarshal(data_from_players_file, &playersUnmarsh)
+	// Get the current players.json from the WebApp
+	err = refresh_web_players(s)
 	if err != nil {
-		fmt.Println("error: ", err)
-
-	}
-
-	// create map of WebUserId -> web_player_t
-	for _, b := range playersUnmarsh {
-		mapWebUserIdToPlayer[b.WebUserId] = b
-	}
-	// create map of playername to webID
-	for _, b := range playersUnmarsh {
-		mapWebUserNameToWebUserId[b.WebName] = b.WebUserId
+		return fmt.Errorf("could not refresh the players: %w", err)
 	}
 
 	// Find immuatable discord snowflake ID of all players from players.json and save to internal data structures
-	var alternateName string
-	for webId, player := range mapWebUserIdToPlayer {
-		id := mapDiscordNameToCordID[player.DiscordName]
-		if mapDiscordIdExists[id] { //store the id
-			found++
-			player.Discord_id = id
-			mapWebUserIdToPlayer[webId] = player //write the new data to the map
-			//_, err := s.ChannelMessageSend(m.ChannelID, "> Found user: "+player.DiscordName+" with snowflake id:"+id)
-			checkError(err)
-		} else {
-			//Check forcommon capitalization mistake on first letter
-			if unicode.IsLower(rune(player.DiscordName[0])) {
-				alternateName = strings.ToUpper(string(player.DiscordName[0])) + player.DiscordName[1:]
-			} else if unicode.IsUpper(rune(player.DiscordName[0])) {
-				alternateName = strings.ToLower(string(player.DiscordName[0])) + player.DiscordName[1:]
-			}
-			id := mapDiscordNameToCordID[alternateName]
-			if mapDiscordIdExists[id] { //store the id
+	for _, player := range all_web_players() {
+		if ctx.Err() != nil {
+			break
+		}
+		webId := player.WebUserId
+		if link, ok := get_manual_link(webId); ok { // bindings made by an admin are authoritative
+			if link.DiscordId != "" && discord_id_exists(link.DiscordId) {
 				found++
-				player.Discord_id = id
-				mapWebUserIdToPlayer[webId] = player //write the new data to the map
-				misspelled++
-				_, err := s.ChannelMessageSend(m.ChannelID, "> Found misspelled user: "+player.DiscordName+" with snowflake id:"+id)
-				checkError(err)
+				recordLink(player, link.DiscordId)
+				update_web_player(webId, func(p *web_player_t) {
+					p.Discord_id = link.DiscordId
+					p.Left_server = false
+				})
 			} else {
 				missing++
-				fmt.Println("Missing user:", player.DiscordName)
-				_, err := s.ChannelMessageSend(m.ChannelID, "[ERROR] cant find user: "+player.DiscordName)
+				_, err := s.ChannelMessageSend(m.ChannelID, "[ERROR] cant find user: "+player.WebName+" (unlinked by an admin or linked account left, use /link)")
 				checkError(err)
 			}
+			continue
+		}
+
+		candidates := match_web_player(player, members)
+		switch {
+		case len(candidates) == 1 && candidates[0].Certainty >= MATCH_AUTO_ACCEPT_CERTAINTY: //store the id
+			found++
+			recordLink(player, candidates[0].DiscordId)
+			player, _ = update_web_player(webId, func(p *web_player_t) { //write the new data to the map
+				p.Discord_id = candidates[0].DiscordId
+				p.Left_server = false
+			})
+			forget_match_review(webId)
+			if candidates[0].Certainty < 100 {
+				misspelled++
+				_, err := s.ChannelMessageSend(m.ChannelID, "> Found misspelled user: "+player.DiscordName+" as "+candidates[0].DiscordName+" ("+candidates[0].Reason+") with snowflake id:"+player.Discord_id)
+				checkError(err)
+			}
+		case len(candidates) > 0: // not sure enough, ask an admin
+			review++
+			queue_match_review(s, m.ChannelID, player, candidates)
+		default:
+			missing++
+			log_debug("missing user", log_fields{"command": "/scan_users", "player": player.WebUserId, "discord_name": player.DiscordName})
+			_, err := s.ChannelMessageSend(m.ChannelID, "[ERROR] cant find user: "+player.WebName+" ("+player.DiscordName+")")
+			checkError(err)
 		}
-		reset_dangerous_commands_status()
 	}
 
 	// find Dada
@@ -1288,18 +1509,26 @@ func scan_web_players(s *discordgo.Session, m *discordgo.MessageCreate) {
 	//fmt.Println(dada)
 	message := DIFF_MSG_START
 	message += "+ /scan_missing USER SCAN COMPLETE\n"
-	message += fmt.Sprintf("**Found:** %d\n**Found Typo'd user:** %d\n**Missing:** %d", found, misspelled, missing)
+	message += fmt.Sprintf("**Found:** %d\n**Found Typo'd user:** %d\n**Needs review:** %d\n**Missing:** %d", found, misspelled, review, missing)
+	if ctx.Err() != nil {
+		message += "\n- CANCELLED, the players after the ones counted above were not scanned"
+	}
 	message += DIFF_MSG_END
 	_, err = s.ChannelMessageSend(m.ChannelID, message)
 	checkError(err)
 
 	// store updated maps and discordusers
-	store_data(discordUsers, "discordUsers")
-	store_data(mapWebUserNameToWebUserId, "mapWebUserNameToWebUserId")
-	store_data(mapWebUserNameToWebUserId, "mapWebUserNameToWebUserId")
-	store_data(mapDiscordNameToCordID, "mapDiscordNameToCordID")
-	store_data(mapDiscordIdExists, "mapDiscordIdExists")
-	store_data(mapWebUserIdToPlayer, "mapWebUserIdToPlayer")
+	err = store_discord_lookups()
+	if err == nil {
+		if err = store_roster(); err != nil {
+			err = fmt.Errorf("could not store the roster: %w", err)
+		}
+	}
+	for _, entry := range linked {
+		entry.Result = audit_result(err)
+		append_audit_log(entry)
+	}
+	return err
 }
 
 // Parse past messages from channel this func is called
@@ -1309,7 +1538,8 @@ func parse_past_messages(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 	for _, message := range messagesFromChannel {
 		if strings.Contains(message.Content, "twitch.tv") {
-			log.Println("[CPL-CLIPS] " + message.Content + " <br>")
+			reportLog.Println("[CPL-CLIPS] " + message.Content + " <br>")
+			metricClipsLogged.inc()
 		}
 	}
 
@@ -1318,344 +1548,126 @@ func parse_past_messages(s *discordgo.Session, m *discordgo.MessageCreate) {
 // Log messages from the clips channel that contain "twitch.tv"
 func parse_message_in_clips_channel(s *discordgo.Session, m *discordgo.MessageCreate) {
 	if strings.Contains(m.Content, "twitch.tv") {
-		log.Println("[CPL-CLIPS] " + m.Content + " <br>")
+		reportLog.Println("[CPL-CLIPS] " + m.Content + " <br>")
+		metricClipsLogged.inc()
 	}
 }
 
-// Assigns/creates roles based on entry on web
-func assign_roles_from_json(s *discordgo.Session, m *discordgo.MessageCreate) {
-	dangerousCommands.isInUse = true
-	dangerousCommands.cmdName = "/assign_roles_from_json"
-	/* key = meaning */
-	const PROTOSS int = 6
-	const ZERG int = 7
-	const TERRAN int = 8
-	const DECLARED_WEEKLY int = 9
-	const RACE_PICKER int = 10
-	const TEAM_ADMIN int = 7
-	const CASTER int = 8
-	const LIQUIPEDIA_UPDATES int = 9
-	const GRAPHICS int = 10
-	const DEV int = 11
-	const OTHER int = 12
-	//helper roles
-	const PLAYER int = 4
-	const COACH int = 5
-	const ASSISTANT_COACH int = 6
-
-	/*
-			assign:
-		Team
-		Tier
-		Race"
-	*/
-
-	//stats, count every time a role was assigned
-	var team1Count int
-	var team2Count int
-	var team3Count int
-	var team4Count int
-	var team5Count int
-	var team6Count int
-	var tier0Count int
-	var tier1Count int
-	var tier2Count int
-	var tier3Count int
-	var raceCount int
-	var coachCount int
-	var assisCoachCount int
-	var totalRoleAssignments int
-
-	for _, usr := range mapWebUserIdToPlayer {
-
-		switch usr.Team {
-		case "Team 1":
-			fmt.Println("assign", usr.DiscordName, "to Team 1")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TEAM1_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			team1Count++
-
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "Team 1")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				fmt.Println(cordMessage)
-				checkError(err)
-			}
-
-		case "Team 2":
-			fmt.Println("assign", usr.DiscordName, "to Team 2")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TEAM2_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			team2Count++
-
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "Team 2")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				fmt.Println(cordMessage)
-				checkError(err)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign team to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-
-			}
-
-		case "Team 3":
-			fmt.Println("assign", usr.DiscordName, "to Team 3")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TEAM3_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			team3Count++
-
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "Team 3")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign team to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
-
-		case "Team 4":
-			fmt.Println("assign", usr.DiscordName, "to Team 4")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TEAM4_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			team4Count++
-
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "Team 4")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				fmt.Println(cordMessage)
-				checkError(err)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign team to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
-
-		case "Team 5":
-			fmt.Println("assign", usr.DiscordName, "to Team 5")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TEAM5_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			team5Count++
-
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "Team 5")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign team to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
+// Refresh the roster, count the role changes /assignroles would make and ask before making them
+// The conversation holds op until it ends, returns false if there is nothing to confirm
+func start_assignroles_conversation(s *discordgo.Session, m *discordgo.MessageCreate, op *operation_t) bool {
+	// Make sure we don't assign last week's teams
+	err := refresh_web_players(s)
+	if err != nil {
+		err = fmt.Errorf("could not refresh the players: %w", err)
+	}
+	var roles, members int
+	if err == nil {
+		roles, members, err = plan_roster_role_changes(s)
+	}
+	if err != nil {
+		record_command("/assignroles", "error")
+		log_error("/assignroles failed", err, command_fields(m))
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /assignroles ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return false
+	}
+	if roles == 0 {
+		record_command("/assignroles", "ok")
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"+ /assignroles DONE\n+ every linked member already has their roster roles"+DIFF_MSG_END)
+		checkError(err)
+		return false
+	}
 
-		case "Team 6":
-			fmt.Println("assign", usr.DiscordName, "to Team 6")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TEAM6_ROLE_ID)
+	c := new_conversation("/assignroles", m.Author.ID, m.ChannelID, conversation_step_t{
+		Name: "confirm",
+		Kind: STEP_CONFIRM,
+		Prompt: func() string {
+			return FIX_MSG_START + fmt.Sprintf("Apply %d role changes to %d members?", roles, members) + FIX_MSG_END
+		},
+		Answer: func(string) (string, error) {
+			op.extend(RUNNING_LOCK_TTL)
+			_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+"+ /assignroles ROLE ASSIGNMENT STARTED"+FIX_MSG_END)
 			checkError(err)
-			totalRoleAssignments++
-			team6Count++
-
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "Team 6")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				//checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign team to"+usr.WebName+usr.DiscordName)
-				checkError(err)
+			err = assign_roles_from_json(op.ctx, s, m)
+			record_command("/assignroles", command_outcome(err))
+			if err != nil {
+				log_error("/assignroles failed", err, command_fields(m))
 			}
+			return "", err
+		},
+	})
+	c.Ctx = op.ctx
+	c.OnEnd = func(string) { op.release() }
+	start_conversation(s, c)
+	return true
+}
 
-		default:
-			fmt.Println("error", usr.DiscordName, "- no team found")
+// Assigns/creates roles based on entry on web, the roster must be current
+func assign_roles_from_json(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	// Safety net, /snapshot restore puts every member's roles back to how they were before this run
+	snapshot, err := create_role_snapshot(s, "starbot", "before /assignroles")
+	if err != nil {
+		return fmt.Errorf("could not take a role snapshot: %w", err)
+	}
+	_, err = s.ChannelMessageSend(m.ChannelID, "> Took role snapshot "+snapshot.Id+" before changing anything")
+	checkError(err)
 
+	// One job per player on the server, everybody else is only listed in the report
+	var jobs []role_job_t
+	var reports []member_report_t
+	players := make(map[string]web_player_t) // [discord id]player
+	for _, usr := range all_web_players() {
+		if usr.Discord_id == "" || usr.Left_server {
+			reports = append(reports, member_report_t{Name: usr.WebName, DiscordId: usr.Discord_id, Status: "skipped", Error: "not on the server"})
+			continue
 		}
+		player := usr
+		players[player.Discord_id] = player
+		jobs = append(jobs, role_job_t{
+			Name:      player.WebName,
+			DiscordId: player.Discord_id,
+			Run:       func() ([]string, error) { return sync_player_roles(s, player) },
+		})
+	}
+	results := run_role_jobs(ctx, s, m.ChannelID, m.Author.ID, "/assignroles", jobs)
+	reports = append(reports, results...)
 
-		switch usr.Race { // Assign Race
-		case PROTOSS:
-			fmt.Println("assign", usr.DiscordName, "to Protoss")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, PROTOSS_ROLE_ID)
-			checkError(err)
-			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TERRAN_ROLE_ID)
-			checkError(err)
-			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, ZERG_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			raceCount++
-
-		case ZERG:
-			fmt.Println("assign", usr.DiscordName, "to Zerg")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, ZERG_ROLE_ID)
-			checkError(err)
-			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TERRAN_ROLE_ID)
-			checkError(err)
-			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, PROTOSS_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			raceCount++
-
-		case TERRAN:
-			fmt.Println("assign", usr.DiscordName, "to Terran")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TERRAN_ROLE_ID)
-			checkError(err)
-			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, ZERG_ROLE_ID)
-			checkError(err)
-			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, PROTOSS_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			raceCount++
-
-		case DECLARED_WEEKLY:
-			// idk what to do here, maybe nothing?
-
-		case RACE_PICKER:
-
-		default:
-			fmt.Println("error", usr.DiscordName, "- no race found")
+	//stats, count the members that have their roles now
+	teamCounts := make(map[string]int) // [team name]members
+	var coachCount int
+	var assisCoachCount int
+	for _, r := range results {
+		if r.Status == "failed" {
+			continue
 		}
-
-		switch usr.Tier { // Assign Tier
-		case 999:
-			fmt.Println("removed all tiers from", usr.DiscordName)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER0_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER1_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER2_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER3_ROLE_ID)
-			cordMessage := fmt.Sprintf("> Removed all tiers from <@%s> %s\n", usr.Discord_id, usr.WebName)
-			_, err := s.ChannelMessageSend(m.ChannelID, cordMessage)
-			checkError(err)
-
-		case 0:
-			fmt.Println("assign", usr.DiscordName, "to Tier0")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TIER0_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER1_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER2_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER3_ROLE_ID)
-			totalRoleAssignments++
-			tier0Count++
-			checkError(err)
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "TIER 0")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				//checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign tier to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
-
-		case 1:
-			fmt.Println("assign", usr.DiscordName, "to Tier1")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TIER1_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER0_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER2_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER3_ROLE_ID)
-			totalRoleAssignments++
-			tier1Count++
-			checkError(err)
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "TIER 1")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				//checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign tier to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
-
-		case 2:
-			fmt.Println("assign", usr.DiscordName, "to Tier2")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TIER2_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER0_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER1_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER3_ROLE_ID)
-			totalRoleAssignments++
-			tier2Count++
-			checkError(err)
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "TIER 2")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				//checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign tier to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
-
-		case 3:
-			fmt.Println("assign", usr.DiscordName, "to Tier3")
-			err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, TIER3_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER2_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER1_ROLE_ID)
-			_ = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, usr.Discord_id, TIER0_ROLE_ID)
-			checkError(err)
-			totalRoleAssignments++
-			tier3Count++
-			if err == nil {
-				cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "TIER 3")
-				//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-				//checkError(err)
-				fmt.Println(cordMessage)
-			} else {
-				_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign tier to"+usr.WebName+usr.DiscordName)
-				checkError(err)
-			}
-
-		default:
-			fmt.Println("error", usr.DiscordName, "- no Tier found")
+		usr := players[r.DiscordId]
+		if team, ok := resolve_team(usr.Team); ok {
+			teamCounts[team.Name]++
 		}
-
 		for _, role := range usr.Helper_role {
-			switch role { // Assign Coach/Assistant Coach/Player
-			case PLAYER:
-				fmt.Println("assign", usr.DiscordName, "to Player")
-			case COACH:
-				fmt.Println("assign", usr.DiscordName, "to Coach")
-				totalRoleAssignments++
+			switch role {
+			case WEB_HELPER_COACH:
 				coachCount++
-				err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, COACH_ROLE_ID)
-				checkError(err)
-				if err == nil {
-					cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "COACH")
-					//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-					//checkError(err)
-					fmt.Println(cordMessage)
-				} else {
-					_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign COACH to"+usr.WebName+usr.DiscordName)
-					checkError(err)
-				}
-
-			case ASSISTANT_COACH:
-				fmt.Println("assign", usr.DiscordName, "to Assistant Coach")
-				err := s.GuildMemberRoleAdd(DISCORD_SERVER_ID, usr.Discord_id, ASST_COACH_ROLE_ID)
-				totalRoleAssignments++
+			case WEB_HELPER_ASSISTANT_COACH:
 				assisCoachCount++
-				checkError(err)
-				if err == nil {
-					cordMessage := fmt.Sprintf("> Assigned <@%s> %s to %s\n", usr.Discord_id, usr.WebName, "ASSISTANT COACH")
-					//_, err = s.ChannelMessageSend(m.ChannelID, cordMessage)
-					//checkError(err)
-					fmt.Println(cordMessage)
-				} else {
-					_, err = s.ChannelMessageSend(m.ChannelID, "Couldn't assign ASSISTANT COACH to"+usr.WebName+usr.DiscordName)
-					checkError(err)
-				}
-			default:
-				fmt.Println("error", usr.DiscordName, "- no helper role ")
 			}
 		}
 	}
-	message := DIFF_MSG_START
-	message += "+ /assignroles ROLE ASSIGNMENT COMPLETE\n"
-	totalUsrInTeams := team1Count + team2Count + team3Count + team4Count + team5Count + team6Count
-	message += fmt.Sprintf("**Users assigned to teams:** %d\n**Team 1:** %d\n**Team 2:** %d\n**Team 3:** %d\n**Team 4:** %d\n**Team 5:** %d\n**Team 6:** %d\n", totalUsrInTeams, team1Count, team2Count, team3Count, team4Count, team5Count, team6Count)
-	message += fmt.Sprintf("**Coaches assigned:** %d\n**Assistant Coaches assigned:** %d\n\n**Total roles assigned**: %d\n", coachCount, assisCoachCount, totalRoleAssignments)
-	message += DIFF_MSG_END
-	_, err := s.ChannelMessageSend(m.ChannelID, message)
-	checkError(err)
+	var totalUsrInTeams int
+	var teamLines string
+	for _, team := range active_teams() {
+		totalUsrInTeams += teamCounts[team.Name]
+		teamLines += fmt.Sprintf("**%s:** %d\n", team.Name, teamCounts[team.Name])
+	}
+	summary := fmt.Sprintf("**Users in teams:** %d\n", totalUsrInTeams) + teamLines
+	summary += fmt.Sprintf("**Coaches:** %d\n**Assistant Coaches:** %d\n", coachCount, assisCoachCount)
+	send_role_report(s, m.ChannelID, "/assignroles", summary, reports)
+
+	if failed := count_reports(results)["failed"]; failed > 0 {
+		return fmt.Errorf("%d of %d members failed, see the report", failed, len(jobs))
+	}
+	return nil
 }
 
 func main() {
@@ -1663,19 +1675,20 @@ func main() {
 	#####	*/
 	// Check to make sure a bot auth token was supplied on startup
 	if len(os.Args) < 2 || len(os.Args) > 2 {
-		fmt.Println("Error: You must supply EXACTLY one argument (the bot's authorization token) on startup.")
+		log_event(LOG_ERROR, "You must supply EXACTLY one argument (the bot's authorization token) on startup.", nil)
 		os.Exit(1)
 	}
 
 	TOKEN = os.Args[1] // discord API Token
 
-	// Open file for match report logging
+	// Open file for the match and clip report, the operational log goes to stdout
 	logfile, err := os.OpenFile("log.html", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		checkError(err)
+		log_error("could not open the report", err, log_fields{"file": "log.html"})
+	} else {
+		defer logfile.Close() //close file when main exits
+		reportLog.SetOutput(logfile)
 	}
-	defer logfile.Close() //close file when main exits
-	log.SetOutput(logfile)
 
 	// Load persistent data into memory
 	load_persistent_internal_data_structures()
@@ -1683,21 +1696,52 @@ func main() {
 	// Initiate discord session through the discord API
 	dg, err := discordgo.New("Bot " + TOKEN)
 	if err != nil {
-		fmt.Println("Error creating discord session", err)
+		log_error("could not create discord session", err, nil)
 	}
 
 	// Register scan_message as a callback func for message events
 	dg.AddHandler(scan_message)
 
+	// Register on_interaction for button clicks
+	dg.AddHandler(on_interaction)
+
+	// Register on_member_update to track name changes of known players
+	dg.AddHandler(on_member_update)
+
+	// Register on_member_join to give known players their roles when they join
+	dg.AddHandler(on_member_join)
+
+	// Register on_member_leave to alert coaches and staff when rostered players leave
+	dg.AddHandler(on_member_leave)
+
+	// Register on_role_delete so team roles deleted by hand leave the team registry
+	dg.AddHandler(on_role_delete)
+
+	// Register on_ready to reload the member cache after every (re)connect
+	dg.AddHandler(on_ready)
+
 	// Receive all events on the server
 	dg.Identify.Intents = discordgo.IntentsAll
 
+	// Count REST calls, rate limits and gateway reconnects for /metrics
+	instrument_session(dg)
+
 	// Establish the discord session
 	err = dg.Open()
 	if err != nil {
-		fmt.Println("Error opening connection", err)
+		log_error("could not open connection", err, nil)
 		os.Exit(1)
 	}
+	botSession = dg
+
+	// Listen for WebApp webhooks
+	go start_http_server()
+
+	// Report a dangerous command that was cut off by a crash or restart
+	recover_operation_lock(dg)
+
+	// Catch name changes that happened while the bot was offline
+	go compare_member_names_on_startup(dg)
 	//##### End of startup procedures
 
 	/* TESTING WIP:
@@ -1708,14 +1752,14 @@ func main() {
 	/* Shutdown procedures
 	##### */
 	// Keep running until exit signal is received..
-	fmt.Println("Bot is running..")
+	log_info("Bot is running..", log_fields{"guild": DISCORD_SERVER_ID})
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 	<-sc
 
 	// Gracefully close down the Discord session on exit
 	dg.Close()
-	fmt.Printf("\nBot exited gracefully.\n")
+	log_info("Bot exited gracefully.", nil)
 
 	//##### end of shutdown procedures
 }
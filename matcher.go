@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Candidates at or above this certainty are linked without asking an admin
+const MATCH_AUTO_ACCEPT_CERTAINTY int = 85
+
+// Characters that are commonly used to imitate latin letters in discord names
+var CONFUSABLES = map[rune]rune{
+	'0': 'o', '1': 'l', '|': 'l', '!': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '$': 's', '@': 'a',
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'х': 'x', 'у': 'y', 'і': 'i', 'ј': 'j', 'ѕ': 's', // cyrillic
+	'α': 'a', 'ε': 'e', 'ο': 'o', 'ρ': 'p', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'τ': 't', 'υ': 'u', 'χ': 'x', // greek
+}
+
+// A discord account that might belong to a web player
+type match_candidate_t struct {
+	DiscordId   string
+	DiscordName string // username#discriminator
+	Nick        string
+	Certainty   int    // 0-100
+	Reason      string // which matching step found the candidate
+}
+
+// Candidates for a web player that wait for an admin to accept or reject them
+var mapMatchReviews = map[int][]match_candidate_t{} // [WebUserId]candidates
+// Remembered admin decisions, true = accepted, false = rejected
+var mapMatchDecisions = map[string]bool{} // [WebUserId:DiscordId]decision
+
+func match_decision_key(webId int, discordId string) string {
+	return strconv.Itoa(webId) + ":" + discordId
+}
+
+// Returns the discord name without the #discriminator
+func strip_discriminator(name string) string {
+	if i := strings.LastIndex(name, "#"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// Lowercase, NFKC normalize, drop invisible characters and replace look-alike characters
+func normalize_name(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKC.String(strings.ToLower(name)) {
+		if unicode.Is(unicode.Cf, r) || unicode.IsSpace(r) { // zero width joiners etc.
+			continue
+		}
+		if c, ok := CONFUSABLES[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Levenshtein distance between two strings
+func edit_distance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min_int(min_int(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min_int(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Find the discord members that could be the web player
+// The steps are tried in order and the candidates of the first step that finds any are returned:
+// exact, case-insensitive, confusables, nickname, pomelo usernames, edit distance
+// Candidates an admin rejected before are skipped, an accepted candidate is returned right away
+func match_web_player(player web_player_t, members []*discordgo.Member) []match_candidate_t {
+	if strings.TrimSpace(player.DiscordName) == "" {
+		return nil
+	}
+
+	webName := player.DiscordName
+	webBase := strip_discriminator(webName)
+	webNorm := normalize_name(webBase)
+	steps := []struct {
+		reason    string
+		certainty int
+		matches   func(u *discordgo.Member) bool
+	}{
+		{"exact", 100, func(u *discordgo.Member) bool {
+			return u.User.String() == webName
+		}},
+		{"case-insensitive", 95, func(u *discordgo.Member) bool {
+			return strings.EqualFold(u.User.String(), webName)
+		}},
+		{"look-alike characters", 90, func(u *discordgo.Member) bool {
+			return normalize_name(u.User.Username) == webNorm && (webBase == webName || strings.HasSuffix(webName, "#"+u.User.Discriminator))
+		}},
+		{"nickname", 70, func(u *discordgo.Member) bool {
+			return u.Nick != "" && normalize_name(u.Nick) == webNorm
+		}},
+		{"username without discriminator", 85, func(u *discordgo.Member) bool {
+			return (u.User.Discriminator == "0" || webBase == webName) && strings.EqualFold(u.User.Username, webBase)
+		}},
+		{"similar name", 0, func(u *discordgo.Member) bool {
+			return len([]rune(webNorm)) >= 4 && edit_distance(normalize_name(u.User.Username), webNorm) <= 2
+		}},
+	}
+
+	for _, step := range steps {
+		var candidates []match_candidate_t
+		for _, u := range members {
+			if u.User == nil || u.User.Bot || !step.matches(u) {
+				continue
+			}
+			key := match_decision_key(player.WebUserId, u.User.ID)
+			rosterMutex.RLock()
+			accepted, decided := mapMatchDecisions[key]
+			rosterMutex.RUnlock()
+			if decided && !accepted {
+				continue
+			}
+			candidate := match_candidate_t{
+				DiscordId:   u.User.ID,
+				DiscordName: u.User.String(),
+				Nick:        u.Nick,
+				Certainty:   step.certainty,
+				Reason:      step.reason,
+			}
+			if step.certainty == 0 { // the closer the name, the more certain
+				candidate.Certainty = 65 - 10*edit_distance(normalize_name(u.User.Username), webNorm)
+			}
+			if decided && accepted {
+				candidate.Certainty = 100
+				candidate.Reason = "accepted by an admin"
+				return []match_candidate_t{candidate}
+			}
+			candidates = append(candidates, candidate)
+		}
+		if len(candidates) > 1 { // ambiguous, let an admin pick
+			for i := range candidates {
+				candidates[i].Certainty = min_int(candidates[i].Certainty, MATCH_AUTO_ACCEPT_CERTAINTY-1)
+			}
+		}
+		if len(candidates) > 0 {
+			if len(candidates) > 5 {
+				candidates = candidates[:5] // discord allows at most 5 rows of buttons
+			}
+			return candidates
+		}
+	}
+	return nil
+}
+
+// Post the candidates of a web player with accept/reject buttons so an admin can decide
+func queue_match_review(s *discordgo.Session, channelID string, player web_player_t, candidates []match_candidate_t) {
+	rosterMutex.Lock()
+	mapMatchReviews[player.WebUserId] = candidates
+	store_data(mapMatchReviews, "mapMatchReviews")
+	rosterMutex.Unlock()
+
+	content, components := render_match_review(player)
+	_, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: components,
+	})
+	checkError(err)
+}
+
+// Build the review message for the pending candidates of a web player
+func render_match_review(player web_player_t) (string, []discordgo.MessageComponent) {
+	rosterMutex.RLock()
+	candidates := mapMatchReviews[player.WebUserId]
+	rosterMutex.RUnlock()
+	content := fmt.Sprintf("**Review:** who is %s (web discord name `%s`)?\n", player.WebName, player.DiscordName)
+	var rows []discordgo.MessageComponent
+	for i, c := range candidates {
+		content += fmt.Sprintf("%d. <@%s> `%s`", i+1, c.DiscordId, c.DiscordName)
+		if c.Nick != "" {
+			content += fmt.Sprintf(" (nick `%s`)", c.Nick)
+		}
+		content += fmt.Sprintf(" - %d%% %s\n", c.Certainty, c.Reason)
+
+		key := match_decision_key(player.WebUserId, c.DiscordId)
+		rows = append(rows, discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: fmt.Sprintf("Accept %d", i+1), Style: discordgo.SuccessButton, CustomID: "match:accept:" + key},
+			discordgo.Button{Label: fmt.Sprintf("Reject %d", i+1), Style: discordgo.DangerButton, CustomID: "match:reject:" + key},
+		}})
+	}
+	return content, rows
+}
+
+// Is called by AddHandler for every interaction, hands buttons and select menus to their feature by custom id prefix
+func on_interaction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	customID := i.MessageComponentData().CustomID
+	switch {
+	case strings.HasPrefix(customID, "match:"):
+		handle_match_review(s, i)
+	case strings.HasPrefix(customID, "conv:"):
+		handle_conversation_component(s, i)
+	case strings.HasPrefix(customID, "show:"):
+		handle_show_component(s, i)
+	case strings.HasPrefix(customID, "link:"):
+		handle_link_component(s, i)
+	case strings.HasPrefix(customID, "approval:"):
+		handle_approval_component(s, i)
+	}
+}
+
+// The user who clicked, interactions in servers carry a member instead of a user
+func interaction_user(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// Accept or reject a candidate of the match review queue
+func handle_match_review(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	customID := i.MessageComponentData().CustomID
+	user := interaction_user(i)
+	if user == nil || !user_is_authorized(s, user.ID, "/link") {
+		respond_ephemeral(s, i, "Only members who may use /link can review matches")
+		return
+	}
+
+	// match:<accept|reject>:<WebUserId>:<DiscordId>
+	parts := strings.Split(customID, ":")
+	if len(parts) != 4 {
+		return
+	}
+	webId, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return
+	}
+	discordId := parts[3]
+	rosterMutex.Lock()
+	player, ok := mapWebUserIdToPlayer[webId]
+	if !ok {
+		rosterMutex.Unlock()
+		respond_ephemeral(s, i, "This player is no longer on the roster")
+		return
+	}
+
+	var outcome string
+	switch parts[1] {
+	case "accept":
+		if other, linked := get_web_id_by_discord_id_locked(discordId); linked && other != webId {
+			otherName := mapWebUserIdToPlayer[other].WebName
+			rosterMutex.Unlock()
+			respond_ephemeral(s, i, fmt.Sprintf("<@%s> is already linked to %s, /unlink %s first if this is a different account", discordId, otherName, otherName))
+			return
+		}
+		mapMatchDecisions[match_decision_key(webId, discordId)] = true
+		before := player.Discord_id
+		player.Discord_id = discordId
+		player.Left_server = false
+		mapWebUserIdToPlayer[webId] = player
+		delete(mapMatchReviews, webId)
+		err = store_data(mapWebUserIdToPlayer, "mapWebUserIdToPlayer")
+		append_audit_log(audit_entry_t{
+			Actor:   user.ID,
+			Command: "/scan_users",
+			Action:  "match_accept",
+			Target:  fmt.Sprintf("%s (%d)", player.WebName, webId),
+			Before:  before,
+			After:   discordId,
+			Result:  audit_result(err),
+		})
+		outcome = fmt.Sprintf("%s linked to <@%s> by %s", player.WebName, discordId, user.Username)
+		if err != nil {
+			outcome += ", but it could not be stored: " + err.Error()
+		}
+	case "reject":
+		mapMatchDecisions[match_decision_key(webId, discordId)] = false
+		var pending []match_candidate_t
+		for _, c := range mapMatchReviews[webId] {
+			if c.DiscordId != discordId {
+				pending = append(pending, c)
+			}
+		}
+		mapMatchReviews[webId] = pending
+		if len(pending) == 0 {
+			delete(mapMatchReviews, webId)
+			outcome = fmt.Sprintf("All candidates for %s rejected by %s", player.WebName, user.Username)
+		}
+	default:
+		rosterMutex.Unlock()
+		return
+	}
+	store_data(mapMatchDecisions, "mapMatchDecisions")
+	store_data(mapMatchReviews, "mapMatchReviews")
+	rosterMutex.Unlock()
+
+	data := &discordgo.InteractionResponseData{Content: outcome, Components: []discordgo.MessageComponent{}}
+	if outcome == "" { // still candidates left to review
+		data.Content, data.Components = render_match_review(player)
+	}
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: data,
+	})
+	checkError(err)
+}
+
+// Answer an interaction with a message only the user who clicked can see
+func respond_ephemeral(s *discordgo.Session, i *discordgo.InteractionCreate, message string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: message,
+			Flags:   1 << 6, // ephemeral
+		},
+	})
+	checkError(err)
+}
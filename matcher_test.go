@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+func test_member(id string, username string, discriminator string, nick string) *discordgo.Member {
+	return &discordgo.Member{Nick: nick, User: &discordgo.User{ID: id, Username: username, Discriminator: discriminator}}
+}
+
+func TestMatchWebPlayer(t *testing.T) {
+	saved := mapMatchDecisions
+	t.Cleanup(func() { mapMatchDecisions = saved })
+
+	bot := test_member("9", "Neblime", "1234", "")
+	bot.User.Bot = true
+
+	tests := []struct {
+		name          string
+		discordName   string
+		members       []*discordgo.Member
+		decisions     map[string]bool
+		wantIds       []string
+		wantReason    string
+		wantCertainty int
+	}{
+		{"no discord name", "", []*discordgo.Member{test_member("1", "Neblime", "1234", "")}, nil, nil, "", 0},
+		{"exact", "Neblime#1234", []*discordgo.Member{test_member("1", "Neblime", "1234", "")}, nil, []string{"1"}, "exact", 100},
+		{"exact wins over case-insensitive", "Neblime#1234", []*discordgo.Member{
+			test_member("1", "neblime", "1234", ""),
+			test_member("2", "Neblime", "1234", ""),
+		}, nil, []string{"2"}, "exact", 100},
+		{"case-insensitive", "neblime#1234", []*discordgo.Member{test_member("1", "Neblime", "1234", "")}, nil, []string{"1"}, "case-insensitive", 95},
+		{"look-alike characters", "N3blime#1234", []*discordgo.Member{test_member("1", "Neblime", "1234", "")}, nil, []string{"1"}, "look-alike characters", 90},
+		{"look-alike with another discriminator is only similar", "N3blime#1234", []*discordgo.Member{test_member("1", "Neblime", "4321", "")}, nil, []string{"1"}, "similar name", 65},
+		{"new username", "neblime#5555", []*discordgo.Member{test_member("1", "neblime", "0", "")}, nil, []string{"1"}, "username without discriminator", 85},
+		{"nickname before new username", "neblime#5555", []*discordgo.Member{
+			test_member("1", "neblime", "0", ""),
+			test_member("2", "someone", "0", "Neblime"),
+		}, nil, []string{"2"}, "nickname", 70},
+		{"similar name", "neblime#1234", []*discordgo.Member{test_member("1", "nebime", "0", "")}, nil, []string{"1"}, "similar name", 55},
+		{"short names are not compared by distance", "neb#1234", []*discordgo.Member{test_member("1", "nab", "0", "")}, nil, nil, "", 0},
+		{"bots are skipped", "Neblime#1234", []*discordgo.Member{bot}, nil, nil, "", 0},
+		{"rejected candidates are skipped", "Neblime#1234", []*discordgo.Member{test_member("1", "Neblime", "1234", "")},
+			map[string]bool{"42:1": false}, nil, "", 0},
+		{"rejected exact match falls through to later steps", "Neblime#1234", []*discordgo.Member{
+			test_member("1", "Neblime", "1234", ""),
+			test_member("2", "someone", "0", "Neblime"),
+		}, map[string]bool{"42:1": false}, []string{"2"}, "nickname", 70},
+		{"accepted candidate wins", "neblime#1234", []*discordgo.Member{
+			test_member("1", "Neblime", "1234", ""),
+			test_member("2", "NEBLIME", "1234", ""),
+		}, map[string]bool{"42:2": true}, []string{"2"}, "accepted by an admin", 100},
+		{"ambiguous candidates need a review", "neblime#1234", []*discordgo.Member{
+			test_member("1", "Neblime", "1234", ""),
+			test_member("2", "NEBLIME", "1234", ""),
+		}, nil, []string{"1", "2"}, "case-insensitive", MATCH_AUTO_ACCEPT_CERTAINTY - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapMatchDecisions = tt.decisions
+			if mapMatchDecisions == nil {
+				mapMatchDecisions = map[string]bool{}
+			}
+			player := web_player_t{WebUserId: 42, WebName: "Neblime", DiscordName: tt.discordName}
+
+			got := match_web_player(player, tt.members)
+			if len(got) != len(tt.wantIds) {
+				t.Fatalf("got %d candidates %+v, want %v", len(got), got, tt.wantIds)
+			}
+			for i, c := range got {
+				if c.DiscordId != tt.wantIds[i] {
+					t.Errorf("candidate %d is %s, want %s", i, c.DiscordId, tt.wantIds[i])
+				}
+				if c.Reason != tt.wantReason || c.Certainty != tt.wantCertainty {
+					t.Errorf("candidate %d: %s %d%%, want %s %d%%", i, c.Reason, c.Certainty, tt.wantReason, tt.wantCertainty)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Neblime", "neblime"},
+		{"N3bl1me", "nebllme"},
+		{"N\u0435blim\u0435", "neblime"}, // cyrillic e
+		{"Neb\u200dlime", "neblime"},     // zero width joiner
+		{"Neb lime", "neblime"},
+		{"\uff2e\uff25\uff22\uff2c\uff29\uff2d\uff25", "neblime"}, // fullwidth
+	}
+	for _, tt := range tests {
+		if got := normalize_name(tt.name); got != tt.want {
+			t.Errorf("normalize_name(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
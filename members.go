@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Every member of the server, loaded once and kept current through member add/update/remove events
+// Its lock also guards discordUsers, mapDiscordIdExists and mapDiscordNameToCordID, use the functions below for them
+type member_cache_t struct {
+	sync.RWMutex
+	members map[string]*discordgo.Member // [discord id]member
+	loaded  bool
+}
+
+var memberCache = member_cache_t{members: map[string]*discordgo.Member{}}
+
+func (c *member_cache_t) add(member *discordgo.Member) {
+	if member == nil || member.User == nil {
+		return
+	}
+	c.Lock()
+	c.members[member.User.ID] = member
+	c.Unlock()
+}
+
+func (c *member_cache_t) remove(discordId string) {
+	c.Lock()
+	delete(c.members, discordId)
+	c.Unlock()
+}
+
+func (c *member_cache_t) get(discordId string) (*discordgo.Member, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	member, ok := c.members[discordId]
+	return member, ok
+}
+
+func (c *member_cache_t) all() []*discordgo.Member {
+	c.RLock()
+	defer c.RUnlock()
+	members := make([]*discordgo.Member, 0, len(c.members))
+	for _, member := range c.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// Page through GuildMembers until every member of the server is in the cache
+func load_member_cache(s *discordgo.Session) error {
+	members := make(map[string]*discordgo.Member)
+	after := ""
+	for {
+		page, err := s.GuildMembers(DISCORD_SERVER_ID, after, 1000)
+		if err != nil {
+			return err
+		}
+		for _, member := range page {
+			members[member.User.ID] = member
+		}
+		if len(page) < 1000 {
+			break
+		}
+		after = page[len(page)-1].User.ID
+	}
+
+	memberCache.Lock()
+	memberCache.members = members
+	memberCache.loaded = true
+	memberCache.Unlock()
+	log_info("loaded the member cache", log_fields{"guild": DISCORD_SERVER_ID, "members": len(members)})
+	return nil
+}
+
+// Returns every member of the server, loading the member cache first if needed
+// Also rebuilds the discord name and discord id lookups from the cache
+func get_guild_members(s *discordgo.Session) ([]*discordgo.Member, error) {
+	memberCache.RLock()
+	loaded := memberCache.loaded
+	memberCache.RUnlock()
+	if !loaded {
+		err := load_member_cache(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refresh_discord_lookups(), nil
+}
+
+// Rebuild discordUsers, mapDiscordIdExists and mapDiscordNameToCordID from the member cache
+func refresh_discord_lookups() []*discordgo.Member {
+	memberCache.Lock()
+	defer memberCache.Unlock()
+	members := make([]*discordgo.Member, 0, len(memberCache.members))
+	exists := make(map[string]bool, len(memberCache.members))
+	for _, u := range memberCache.members {
+		members = append(members, u)
+		mapDiscordNameToCordID[u.User.String()] = u.User.ID
+		exists[u.User.ID] = true
+	}
+	discordUsers = members
+	mapDiscordIdExists = exists
+	return members
+}
+
+// Returns true if the discord id is a member of the server
+func discord_id_exists(discordId string) bool {
+	memberCache.RLock()
+	defer memberCache.RUnlock()
+	return mapDiscordIdExists[discordId]
+}
+
+// Returns the discord id of a name like discordgo prints it (name#1234, or name#0 for unique usernames)
+func discord_id_by_name(name string) string {
+	memberCache.RLock()
+	defer memberCache.RUnlock()
+	return mapDiscordNameToCordID[name]
+}
+
+// Persist discordUsers and the discord name and id lookups in ./data
+func store_discord_lookups() error {
+	memberCache.RLock()
+	defer memberCache.RUnlock()
+	for name, data := range map[string]interface{}{
+		"discordUsers":           discordUsers,
+		"mapDiscordNameToCordID": mapDiscordNameToCordID,
+		"mapDiscordIdExists":     mapDiscordIdExists,
+	} {
+		err := store_data(data, name)
+		if err != nil {
+			return fmt.Errorf("could not store %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Is called by AddHandler every time the gateway connection is (re)established
+// Member events that happened while the bot was disconnected are lost, so the member cache is loaded again
+func on_ready(s *discordgo.Session, r *discordgo.Ready) {
+	go func() {
+		err := load_member_cache(s)
+		if err != nil {
+			checkError(err)
+			return
+		}
+		refresh_discord_lookups()
+	}()
+}
+
+// Returns a member of the server from the cache, falls back to asking discord
+func get_guild_member(s *discordgo.Session, discordId string) (*discordgo.Member, error) {
+	if member, ok := memberCache.get(discordId); ok {
+		return member, nil
+	}
+	member, err := s.GuildMember(DISCORD_SERVER_ID, discordId)
+	if err != nil {
+		return nil, err
+	}
+	memberCache.add(member)
+	return member, nil
+}
+
+// Is called by AddHandler every time someone joins the server
+// Known players get their roster roles right away instead of waiting for the next /assignroles
+func on_member_join(s *discordgo.Session, u *discordgo.GuildMemberAdd) {
+	if u.GuildID != DISCORD_SERVER_ID || u.User == nil || u.User.Bot {
+		return
+	}
+	memberCache.add(u.Member)
+	memberCache.Lock()
+	mapDiscordIdExists[u.User.ID] = true
+	mapDiscordNameToCordID[u.User.String()] = u.User.ID
+	memberCache.Unlock()
+
+	webId, found := match_member_to_roster(u.Member)
+	if !found {
+		send_staff_message(s, fmt.Sprintf("> <@%s> %s joined the server but is not on the roster", u.User.ID, u.User.String()))
+		return
+	}
+	player, _ := get_web_player(webId)
+
+	changes, err := sync_player_roles(s, player)
+	if err != nil {
+		checkError(err)
+		send_staff_message(s, fmt.Sprintf("> %s (<@%s>) rejoined, could not assign roles: %s", player.WebName, player.Discord_id, err))
+	} else {
+		send_staff_message(s, fmt.Sprintf("> %s (<@%s>) joined, roster roles: %s", player.WebName, player.Discord_id, strings.Join(changes, " ")))
+	}
+
+	send_welcome_message(s, player)
+}
+
+// Returns the WebApp ID of the roster entry for a member, first by stored discord id, then by discord name
+// Names are compared like /scan_users does (name#0, case, look-alikes), only a single sure match counts
+// A match by name is saved so future lookups don't depend on the name
+func match_member_to_roster(member *discordgo.Member) (int, bool) {
+	webId, ok := get_web_id_by_discord_id(member.User.ID)
+	if !ok {
+		best := 0
+		for _, player := range all_web_players() {
+			if player.Discord_id != "" {
+				continue
+			}
+			if _, manual := get_manual_link(player.WebUserId); manual {
+				continue // an admin decided who this player is
+			}
+			candidates := match_web_player(player, []*discordgo.Member{member})
+			if len(candidates) == 0 || candidates[0].Certainty < MATCH_AUTO_ACCEPT_CERTAINTY {
+				continue
+			}
+			switch {
+			case candidates[0].Certainty > best:
+				webId, ok, best = player.WebUserId, true, candidates[0].Certainty
+			case candidates[0].Certainty == best: // two players fit as well, leave it to /scan_users
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+
+	update_web_player(webId, func(p *web_player_t) {
+		p.Discord_id = member.User.ID
+		p.Left_server = false
+	})
+	checkError(store_roster())
+	return webId, true
+}
+
+// Is called by AddHandler every time someone leaves (or is kicked from) the server
+func on_member_leave(s *discordgo.Session, u *discordgo.GuildMemberRemove) {
+	if u.GuildID != DISCORD_SERVER_ID || u.User == nil {
+		return
+	}
+	memberCache.remove(u.User.ID)
+	memberCache.Lock()
+	delete(mapDiscordIdExists, u.User.ID)
+	memberCache.Unlock()
+
+	webId, known := get_web_id_by_discord_id(u.User.ID)
+	if !known {
+		return
+	}
+	player, _ := update_web_player(webId, func(p *web_player_t) {
+		p.Left_server = true
+		p.Left_at = time.Now().UTC()
+	})
+	checkError(store_roster())
+
+	message := fmt.Sprintf("%s (%s, %s, %s) left the server", player.WebName, u.User.String(), team_or_none(player.Team), tier_name(player.Tier))
+	send_staff_message(s, "> "+message)
+
+	// let the coach know so the player doesn't just silently miss their matches
+	coach, ok := get_team_coach(player.Team)
+	if !ok || coach.Discord_id == "" || coach.Discord_id == player.Discord_id {
+		return
+	}
+	channel, err := s.UserChannelCreate(coach.Discord_id)
+	if err != nil {
+		checkError(err)
+		return
+	}
+	_, err = s.ChannelMessageSend(channel.ID, "Roster alert: your player "+message+".")
+	checkError(err)
+}
+
+// Lists rostered players that were never found on the server and players that left it
+func roster_missing_report() string {
+	var neverFound, left []string
+	for _, p := range all_web_players() {
+		switch {
+		case p.Left_server:
+			left = append(left, fmt.Sprintf("%s (%s, %s) left %s", p.WebName, team_or_none(p.Team), p.DiscordName, p.Left_at.Format("2006-01-02")))
+		case p.Discord_id == "" || !discord_id_exists(p.Discord_id):
+			neverFound = append(neverFound, fmt.Sprintf("%s (%s, %s)", p.WebName, team_or_none(p.Team), p.DiscordName))
+		}
+	}
+	sort.Strings(neverFound)
+	sort.Strings(left)
+
+	report := FIX_MSG_START + fmt.Sprintf("/roster missing: %d never found, %d left the server", len(neverFound), len(left)) + FIX_MSG_END
+	if len(neverFound) > 0 {
+		report += "**Never found on the server:**\n" + strings.Join(neverFound, "\n") + "\n"
+	}
+	if len(left) > 0 {
+		report += "**Left the server:**\n" + strings.Join(left, "\n") + "\n"
+	}
+	return report
+}
+
+// Returns the coach of a team from the roster
+func get_team_coach(team string) (web_player_t, bool) {
+	if team == "" {
+		return web_player_t{}, false
+	}
+	if t, ok := resolve_team(team); ok && t.Coach_id != "" { // set with /team coach
+		if webId, found := get_web_id_by_discord_id(t.Coach_id); found {
+			return get_web_player(webId)
+		}
+		return web_player_t{WebName: "<@" + t.Coach_id + ">", Discord_id: t.Coach_id}, true
+	}
+	for _, p := range all_web_players() {
+		if p.Team != team {
+			continue
+		}
+		for _, helper := range p.Helper_role {
+			if helper == WEB_HELPER_COACH {
+				return p, true
+			}
+		}
+	}
+	return web_player_t{}, false
+}
+
+// DM a player that joined the server their team and coach
+func send_welcome_message(s *discordgo.Session, player web_player_t) {
+	channel, err := s.UserChannelCreate(player.Discord_id)
+	if err != nil {
+		checkError(err)
+		return
+	}
+
+	message := fmt.Sprintf("Welcome to the Coach Pupil League, %s!\n", player.WebName)
+	if player.Team == "" {
+		message += "You are not on a team yet, the admins will let you know once teams are set."
+	} else {
+		message += fmt.Sprintf("You are playing for **%s** (%s).", player.Team, tier_name(player.Tier))
+		if coach, ok := get_team_coach(player.Team); ok {
+			if coach.Discord_id != "" {
+				message += fmt.Sprintf("\nYour coach is <@%s> (%s).", coach.Discord_id, coach.WebName)
+			} else {
+				message += fmt.Sprintf("\nYour coach is %s.", coach.WebName)
+			}
+		}
+	}
+	_, err = s.ChannelMessageSend(channel.ID, message)
+	checkError(err) // fails if the member doesn't accept DMs from server members
+}
+
+// username#discriminator of a cached member, the id for members that aren't cached
+func member_name(discordId string) string {
+	if member, ok := memberCache.get(discordId); ok && member.User != nil {
+		return member.User.String()
+	}
+	return discordId
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// A counter or gauge with labels, exposed in the Prometheus text format
+type metric_t struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	values map[string]float64 // [label values joined by \xff]value
+}
+
+var metrics []*metric_t
+
+func new_metric(kind string, name string, help string, labels ...string) *metric_t {
+	m := &metric_t{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+	metrics = append(metrics, m)
+	return m
+}
+
+// Label values must be given in the order the labels were declared
+func (m *metric_t) add(delta float64, labelValues ...string) {
+	m.mutex.Lock()
+	m.values[strings.Join(labelValues, "\xff")] += delta
+	m.mutex.Unlock()
+}
+
+func (m *metric_t) inc(labelValues ...string) { m.add(1, labelValues...) }
+
+func (m *metric_t) set(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	m.values[strings.Join(labelValues, "\xff")] = value
+	m.mutex.Unlock()
+}
+
+var (
+	metricGatewayConnected  = new_metric("gauge", "starbot_gateway_connected", "1 if the discord gateway connection is up")
+	metricGatewayReconnects = new_metric("counter", "starbot_gateway_reconnects_total", "Gateway connections that were re-established or resumed")
+	metricRestRequests      = new_metric("counter", "starbot_rest_requests_total", "Discord REST requests by route and status code", "method", "route", "status")
+	metricRestErrors        = new_metric("counter", "starbot_rest_errors_total", "Discord REST requests that failed or returned an error status", "method", "route")
+	metricRateLimited       = new_metric("counter", "starbot_rate_limited_responses_total", "429 responses discordgo waited out and retried", "route")
+	metricRateLimitSeconds  = new_metric("counter", "starbot_rate_limited_wait_seconds_total", "Seconds spent waiting after 429 responses", "route")
+	metricCommands          = new_metric("counter", "starbot_commands_total", "Commands run by name and outcome", "command", "outcome")
+	metricRoleMutations     = new_metric("counter", "starbot_role_mutations_total", "Member role additions and removals", "action", "outcome")
+	metricMatchReports      = new_metric("counter", "starbot_match_reports_total", "Match reports by result", "result")
+	metricClipsLogged       = new_metric("counter", "starbot_clips_logged_total", "Clip links logged from the clips channel")
+)
+
+var gatewayConnects int32
+
+// GET /metrics
+func handle_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	write_metrics(w)
+}
+
+func write_metrics(w io.Writer) {
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		m.mutex.Lock()
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if len(keys) == 0 && len(m.labels) == 0 {
+			fmt.Fprintf(w, "%s 0\n", m.name)
+		}
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, format_labels(m.labels, k), m.values[k])
+		}
+		m.mutex.Unlock()
+	}
+}
+
+func format_labels(labels []string, key string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	var pairs []string
+	for i, l := range labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Outcome label of a command that returns an error
+func command_outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func record_command(command string, outcome string) {
+	metricCommands.inc(command, outcome)
+}
+
+var snowflakeRegex = regexp.MustCompile(`/\d{15,}`)
+var apiVersionRegex = regexp.MustCompile(`^/api/v\d+`)
+
+// Discord REST path without ids, so every guild/member/role shares one route label
+func rest_route(path string) string {
+	path = apiVersionRegex.ReplaceAllString(path, "")
+	return snowflakeRegex.ReplaceAllString(path, "/:id")
+}
+
+// Counts every REST request discordgo makes
+type metrics_transport_t struct {
+	base http.RoundTripper
+}
+
+func (t *metrics_transport_t) RoundTrip(req *http.Request) (*http.Response, error) {
+	route := rest_route(req.URL.Path)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		metricRestRequests.inc(req.Method, route, "error")
+		metricRestErrors.inc(req.Method, route)
+		return resp, err
+	}
+	metricRestRequests.inc(req.Method, route, fmt.Sprint(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		metricRestErrors.inc(req.Method, route)
+	}
+	return resp, nil
+}
+
+// Hook the metrics into a discord session, call before Open
+func instrument_session(dg *discordgo.Session) {
+	base := dg.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	dg.Client.Transport = &metrics_transport_t{base: base}
+
+	dg.AddHandler(func(s *discordgo.Session, c *discordgo.Connect) {
+		metricGatewayConnected.set(1)
+		if atomic.AddInt32(&gatewayConnects, 1) > 1 { // the first connect isn't a reconnect
+			metricGatewayReconnects.inc()
+		}
+	})
+	dg.AddHandler(func(s *discordgo.Session, r *discordgo.Resumed) {
+		metricGatewayConnected.set(1)
+		metricGatewayReconnects.inc()
+	})
+	dg.AddHandler(func(s *discordgo.Session, d *discordgo.Disconnect) {
+		metricGatewayConnected.set(0)
+		log_warn("gateway disconnected", nil)
+	})
+	// discordgo only reports 429 responses, the waits of its own bucket limiter can't be seen from here
+	dg.AddHandler(func(s *discordgo.Session, r *discordgo.RateLimit) {
+		route := r.URL
+		if u, err := url.Parse(r.URL); err == nil {
+			route = rest_route(u.Path)
+		}
+		metricRateLimited.inc(route)
+		if r.TooManyRequests != nil {
+			metricRateLimitSeconds.add(r.TooManyRequests.RetryAfter.Seconds(), route)
+		}
+	})
+}
+
+// Result of a single health check
+type health_check_t struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// The data store can be written if a probe file can be stored in ./data
+func check_data_store() health_check_t {
+	err := store_data(time.Now().UTC(), ".healthcheck")
+	if err != nil {
+		return health_check_t{Error: err.Error()}
+	}
+	return health_check_t{Ok: true}
+}
+
+// The discord session is connected and received its initial state
+func check_discord_session() health_check_t {
+	if botSession == nil {
+		return health_check_t{Error: "no discord session"}
+	}
+	if !botSession.DataReady {
+		return health_check_t{Error: "gateway not connected"}
+	}
+	if latency := botSession.HeartbeatLatency(); latency > time.Minute {
+		return health_check_t{Error: fmt.Sprintf("heartbeat latency %s", latency.Round(time.Second))}
+	}
+	return health_check_t{Ok: true}
+}
+
+// GET /healthz - the process is alive, has a discord session (that may be reconnecting) and can persist its data
+func handle_healthz(w http.ResponseWriter, r *http.Request) {
+	session := health_check_t{Ok: botSession != nil}
+	if !session.Ok {
+		session.Error = "no discord session"
+	}
+	write_health(w, map[string]health_check_t{
+		"discord_session": session,
+		"data_store":      check_data_store(),
+	})
+}
+
+// GET /readyz - the bot can serve commands: discord is connected and the data store is writable
+func handle_readyz(w http.ResponseWriter, r *http.Request) {
+	write_health(w, map[string]health_check_t{
+		"discord":    check_discord_session(),
+		"data_store": check_data_store(),
+	})
+}
+
+func write_health(w http.ResponseWriter, checks map[string]health_check_t) {
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.Ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"ok": status == http.StatusOK, "checks": checks})
+	checkError(err)
+}
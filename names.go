@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/sheets/v4"
+)
+
+// The names a discord user was known by at some point
+type discord_identity_t struct {
+	Username      string
+	Discriminator string
+	Nick          string
+}
+
+// A change of a known player's discord name or nickname
+type name_change_t struct {
+	At  time.Time
+	Old discord_identity_t
+	New discord_identity_t
+}
+
+var mapDiscordIdToIdentity = map[string]discord_identity_t{} // last seen names of known players
+var mapDiscordIdToNameHistory = map[string][]name_change_t{} // every name change we noticed per player
+var nameHistoryMutex sync.Mutex                              // guards both maps, on_member_update runs alongside the startup comparison
+
+// name#1234, or just the name for accounts with a unique username (their discriminator is "0")
+func (i discord_identity_t) String() string {
+	if i.Discriminator == "" || i.Discriminator == "0" {
+		return i.Username
+	}
+	return i.Username + "#" + i.Discriminator
+}
+
+// The identity with the "0" of unique usernames dropped, so "name" and "name#0" compare equal
+func (i discord_identity_t) normalized() discord_identity_t {
+	if i.Discriminator == "0" {
+		i.Discriminator = ""
+	}
+	return i
+}
+
+// Create a google sheets client from the secret file (google api key to access google sheets)
+func get_sheets_service() (*sheets.Service, error) {
+	data, err := ioutil.ReadFile("./keys/secret.json")
+	if err != nil {
+		return nil, err
+	}
+	conf, err := google.JWTConfigFromJSON(data, sheets.SpreadsheetsScope)
+	if err != nil {
+		return nil, err
+	}
+	return sheets.New(conf.Client(context.TODO()))
+}
+
+// Is called by AddHandler every time a member of the server changes (roles, nickname, username..)
+func on_member_update(s *discordgo.Session, u *discordgo.GuildMemberUpdate) {
+	if u.GuildID != DISCORD_SERVER_ID {
+		return
+	}
+	memberCache.add(u.Member)
+	track_member_name(s, u.Member)
+}
+
+// Compare the names of all known players with what we saw last time the bot was running
+func compare_member_names_on_startup(s *discordgo.Session) {
+	members, err := get_guild_members(s)
+	if err != nil {
+		checkError(err)
+		return
+	}
+	for _, member := range members {
+		track_member_name(s, member)
+	}
+}
+
+// Returns the WebApp ID of the player linked to the discord id
+func get_web_id_by_discord_id(discordId string) (int, bool) {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	return get_web_id_by_discord_id_locked(discordId)
+}
+
+// get_web_id_by_discord_id for callers that already hold rosterMutex
+func get_web_id_by_discord_id_locked(discordId string) (int, bool) {
+	for webId, player := range mapWebUserIdToPlayer {
+		if player.Discord_id == discordId {
+			return webId, true
+		}
+	}
+	return 0, false
+}
+
+// Record name changes of known players and write their new discord name back to the master spreadsheet
+func track_member_name(s *discordgo.Session, member *discordgo.Member) {
+	if member == nil || member.User == nil {
+		return
+	}
+	webId, known := get_web_id_by_discord_id(member.User.ID)
+	if !known {
+		return
+	}
+	player, _ := get_web_player(webId)
+	current := discord_identity_t{
+		Username:      member.User.Username,
+		Discriminator: member.User.Discriminator,
+		Nick:          member.Nick,
+	}.normalized()
+
+	nameHistoryMutex.Lock()
+	stored, seen := mapDiscordIdToIdentity[member.User.ID]
+	old := stored.normalized()
+	if !seen { // first time we see this player, the roster may still hold an outdated name
+		old = discord_identity_t{Nick: member.Nick}
+		if parts := strings.SplitN(player.DiscordName, "#", 2); len(parts) == 2 {
+			old.Username, old.Discriminator = parts[0], parts[1]
+		} else {
+			old.Username = player.DiscordName
+		}
+	}
+	old = old.normalized()
+	if old == current {
+		if !seen || stored != current {
+			mapDiscordIdToIdentity[member.User.ID] = current
+			store_data(mapDiscordIdToIdentity, "mapDiscordIdToIdentity")
+		}
+		nameHistoryMutex.Unlock()
+		return
+	}
+
+	mapDiscordIdToIdentity[member.User.ID] = current
+	mapDiscordIdToNameHistory[member.User.ID] = append(mapDiscordIdToNameHistory[member.User.ID], name_change_t{
+		At:  time.Now().UTC(),
+		Old: old,
+		New: current,
+	})
+	store_data(mapDiscordIdToIdentity, "mapDiscordIdToIdentity")
+	store_data(mapDiscordIdToNameHistory, "mapDiscordIdToNameHistory")
+	nameHistoryMutex.Unlock()
+
+	if old.String() == current.String() {
+		return // only the nickname changed, nothing to update in the sheet
+	}
+
+	// keep the lookups in sync with the new name, they are keyed like discordgo names users (name#0 for unique usernames)
+	memberCache.Lock()
+	delete(mapDiscordNameToCordID, old.String())
+	delete(mapDiscordNameToCordID, old.Username+"#0")
+	mapDiscordNameToCordID[member.User.String()] = member.User.ID
+	store_data(mapDiscordNameToCordID, "mapDiscordNameToCordID")
+	memberCache.Unlock()
+	player, _ = update_web_player(webId, func(p *web_player_t) { p.DiscordName = current.String() })
+	checkError(store_roster())
+
+	err := write_sheet_discord_name(player.WebName, old.String(), current.String())
+	message := fmt.Sprintf("> <@%s> %s changed discord name: %s -> %s", member.User.ID, player.WebName, old, current)
+	if err != nil {
+		message += "\n> Could not update the spreadsheet: " + err.Error()
+	}
+	send_staff_message(s, message)
+}
+
+// Write the new discord name of a player into column B of the "Player List" sheet
+// The row is found by screen name (column A), falling back to the old discord name (column B)
+func write_sheet_discord_name(screenName string, oldName string, newName string) error {
+	srv, err := get_sheets_service()
+	if err != nil {
+		return err
+	}
+	resp, err := srv.Spreadsheets.Values.Get(SPREADSHEET_ID, "Player List!A1:B").Do()
+	if err != nil {
+		return err
+	}
+
+	row := -1
+	for i, r := range resp.Values {
+		if len(r) > 0 && fmt.Sprint(r[0]) == screenName {
+			row = i
+			break
+		}
+		if len(r) > 1 && fmt.Sprint(r[1]) == oldName && row == -1 {
+			row = i
+		}
+	}
+	if row == -1 {
+		return fmt.Errorf("%s not found in Player List", screenName)
+	}
+
+	before := ""
+	if len(resp.Values[row]) > 1 {
+		before = fmt.Sprint(resp.Values[row][1])
+	}
+	target := fmt.Sprintf("Player List!B%d", row+1)
+	values := &sheets.ValueRange{Values: [][]interface{}{{newName}}}
+	_, err = srv.Spreadsheets.Values.Update(SPREADSHEET_ID, target, values).ValueInputOption("RAW").Do()
+
+	entry := audit_entry_t{
+		Actor:   "starbot",
+		Command: "name_change",
+		Action:  "sheet_write",
+		Target:  target,
+		Before:  before,
+		After:   newName,
+		Result:  audit_result(err),
+	}
+	append_audit_log(entry)
+	return err
+}
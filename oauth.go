@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"golang.org/x/oauth2"
+)
+
+// Discord OAuth2 endpoints, variables so a local stand-in provider can be used instead of discord
+var OAUTH_AUTH_URL = "https://discord.com/api/oauth2/authorize"
+var OAUTH_TOKEN_URL = "https://discord.com/api/oauth2/token"
+var OAUTH_USER_URL = "https://discord.com/api/users/@me"
+
+// How long a one-time link from the WebApp can be used
+const OAUTH_LINK_LIFETIME time.Duration = 30 * time.Minute
+
+// Cookie that ties the callback to the browser that opened /link/start, so nobody can log a player in with their own discord account
+const OAUTH_STATE_COOKIE string = "starbot_link_state"
+
+// A one-time link the WebApp requested for one of its users
+type oauth_link_request_t struct {
+	WebUserId int
+	ExpiresAt time.Time
+}
+
+// The part of discord's user object we need
+type oauth_discord_user_t struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Discriminator string `json:"discriminator"`
+}
+
+// What we send back to the WebApp once a player proved which discord account is theirs
+type oauth_link_result_t struct {
+	WebUserId   int    `json:"web_user_id"`
+	DiscordId   string `json:"discord_id"`
+	DiscordName string `json:"discord_name"`
+}
+
+var oauthLinkRequests = map[string]oauth_link_request_t{} // [one-time token]request
+var oauthLinkRequestsMutex sync.Mutex
+
+// OAuth2 config for the discord "identify" scope
+func get_oauth_config() (*oauth2.Config, error) {
+	secret, err := ioutil.ReadFile("./keys/oauth_client_secret")
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Config{
+		ClientID:     OAUTH_CLIENT_ID,
+		ClientSecret: strings.TrimSpace(string(secret)),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   OAUTH_AUTH_URL,
+			TokenURL:  OAUTH_TOKEN_URL,
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		RedirectURL: OAUTH_REDIRECT_URL,
+		Scopes:      []string{"identify"},
+	}, nil
+}
+
+// Returns a random hex token that can't be guessed
+func new_link_token() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// POST /link/create {"web_user_id": 42}, signed like the player webhook
+// Returns {"url": "..."} - a one-time link the WebApp shows to the player
+func handle_link_create(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if err := verify_webhook_request(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		WebUserId int `json:"web_user_id"`
+	}
+	err = json.Unmarshal(body, &req)
+	if err != nil || req.WebUserId <= 0 {
+		http.Error(w, "web_user_id missing", http.StatusBadRequest)
+		return
+	}
+	if _, ok := get_web_player(req.WebUserId); !ok {
+		http.Error(w, "unknown web_user_id", http.StatusNotFound)
+		return
+	}
+
+	token, err := new_link_token()
+	if err != nil {
+		http.Error(w, "could not create link", http.StatusInternalServerError)
+		return
+	}
+	oauthLinkRequestsMutex.Lock()
+	for t, pending := range oauthLinkRequests { // forget links nobody used
+		if time.Now().After(pending.ExpiresAt) {
+			delete(oauthLinkRequests, t)
+		}
+	}
+	oauthLinkRequests[token] = oauth_link_request_t{
+		WebUserId: req.WebUserId,
+		ExpiresAt: time.Now().Add(OAUTH_LINK_LIFETIME),
+	}
+	store_data(oauthLinkRequests, "oauthLinkRequests")
+	oauthLinkRequestsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{
+		"url":        strings.TrimSuffix(OAUTH_PUBLIC_URL, "/") + "/link/start?token=" + token,
+		"expires_at": time.Now().Add(OAUTH_LINK_LIFETIME).UTC().Format(time.RFC3339),
+	})
+	checkError(err)
+}
+
+// GET /link/start?token=... sends the player to discord to log in
+func handle_link_start(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	oauthLinkRequestsMutex.Lock()
+	pending, ok := oauthLinkRequests[token]
+	oauthLinkRequestsMutex.Unlock()
+	if !ok || time.Now().After(pending.ExpiresAt) {
+		write_link_page(w, http.StatusGone, "This link has expired or was already used. Please request a new one in the WebApp.")
+		return
+	}
+	conf, err := get_oauth_config()
+	if err != nil {
+		checkError(err)
+		write_link_page(w, http.StatusInternalServerError, "Account linking is not configured.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     OAUTH_STATE_COOKIE,
+		Value:    token,
+		Path:     "/link/",
+		Expires:  pending.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(OAUTH_PUBLIC_URL, "https://"),
+		SameSite: http.SameSiteLaxMode, // sent along when discord redirects back
+	})
+	http.Redirect(w, r, conf.AuthCodeURL(token), http.StatusFound)
+}
+
+// GET /link/callback?code=...&state=... records the verified discord account of the player
+func handle_link_callback(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(OAUTH_STATE_COOKIE)
+	if err != nil || token == "" || !hmac.Equal([]byte(cookie.Value), []byte(token)) {
+		write_link_page(w, http.StatusForbidden, "Please open the link from the WebApp in this browser and try again.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: OAUTH_STATE_COOKIE, Path: "/link/", MaxAge: -1})
+
+	oauthLinkRequestsMutex.Lock()
+	pending, ok := oauthLinkRequests[token]
+	delete(oauthLinkRequests, token) // one-time, even if the login fails
+	store_data(oauthLinkRequests, "oauthLinkRequests")
+	oauthLinkRequestsMutex.Unlock()
+	if !ok || time.Now().After(pending.ExpiresAt) {
+		write_link_page(w, http.StatusGone, "This link has expired or was already used. Please request a new one in the WebApp.")
+		return
+	}
+	if r.URL.Query().Get("error") != "" {
+		write_link_page(w, http.StatusForbidden, "Discord login was cancelled.")
+		return
+	}
+
+	user, err := get_oauth_discord_user(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		checkError(err)
+		write_link_page(w, http.StatusBadGateway, "Could not verify your discord account, please try again.")
+		return
+	}
+
+	// check and link under one lock, so two players can't claim the same account at once
+	rosterMutex.Lock()
+	player, ok := mapWebUserIdToPlayer[pending.WebUserId]
+	if !ok {
+		rosterMutex.Unlock()
+		write_link_page(w, http.StatusNotFound, "Your WebApp account is not on the roster.")
+		return
+	}
+	if webId, linked := get_web_id_by_discord_id_locked(user.ID); linked && webId != player.WebUserId {
+		rosterMutex.Unlock()
+		write_link_page(w, http.StatusConflict, "This discord account is already linked to another player, please contact an admin.")
+		return
+	}
+	set_manual_link_locked(player, user.ID, user.ID, "oauth_link")
+	rosterMutex.Unlock()
+
+	result := oauth_link_result_t{
+		WebUserId:   player.WebUserId,
+		DiscordId:   user.ID,
+		DiscordName: user.Username + "#" + user.Discriminator,
+	}
+	err = send_link_result(result)
+	if err != nil {
+		checkError(err)
+	}
+	if botSession != nil {
+		send_staff_message(botSession, fmt.Sprintf("> %s verified their discord account <@%s>", player.WebName, user.ID))
+	}
+	write_link_page(w, http.StatusOK, fmt.Sprintf("Linked %s to %s. You can close this page.", player.WebName, result.DiscordName))
+}
+
+// Exchange the authorization code and ask the provider who logged in
+func get_oauth_discord_user(ctx context.Context, code string) (oauth_discord_user_t, error) {
+	var user oauth_discord_user_t
+	conf, err := get_oauth_config()
+	if err != nil {
+		return user, err
+	}
+	token, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return user, err
+	}
+	resp, err := conf.Client(ctx, token).Get(OAUTH_USER_URL)
+	if err != nil {
+		return user, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return user, fmt.Errorf("%s returned %s", OAUTH_USER_URL, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	if err == nil && user.ID == "" {
+		err = fmt.Errorf("%s returned no user id", OAUTH_USER_URL)
+	}
+	return user, err
+}
+
+// Tell the WebApp which discord account a player verified (signed like the player webhook)
+func send_link_result(result oauth_link_result_t) error {
+	if WEBAPP_LINK_RESULT_URL == "" {
+		return nil
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	timestamp, signature, err := sign_webhook_body(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", WEBAPP_LINK_RESULT_URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Starbot-Timestamp", timestamp)
+	req.Header.Set("X-Starbot-Signature", signature)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("WebApp link result returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Minimal page shown to the player at the end of the flow
+func write_link_page(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html><html><head><title>Starbot</title></head><body><p>%s</p></body></html>", html.EscapeString(message))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDiscordId = "123456789012345678"
+
+// Run the test in an empty directory with ./keys and ./data, and a stand-in for discord's OAuth2 endpoints
+// The stand-in only accepts the code "good-code" and then reports testDiscordId as the logged in user
+func setup_oauth_test(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, sub := range []string{"keys", "data"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys", "oauth_client_secret"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := http.NewServeMux()
+	provider.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "token_type": "Bearer", "expires_in": 3600})
+	})
+	provider.HandleFunc("/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(oauth_discord_user_t{ID: testDiscordId, Username: "neblime", Discriminator: "0"})
+	})
+	server := httptest.NewServer(provider)
+
+	authURL, tokenURL, userURL := OAUTH_AUTH_URL, OAUTH_TOKEN_URL, OAUTH_USER_URL
+	OAUTH_AUTH_URL, OAUTH_TOKEN_URL, OAUTH_USER_URL = server.URL+"/authorize", server.URL+"/token", server.URL+"/users/@me"
+
+	use_test_roster(t, web_player_t{WebUserId: 42, WebName: "Neblime"})
+	savedLinks, savedReviews, savedRequests := mapManualLinks, mapMatchReviews, oauthLinkRequests
+	mapManualLinks = map[int]manual_link_t{}
+	mapMatchReviews = map[int][]match_candidate_t{}
+	oauthLinkRequests = map[string]oauth_link_request_t{
+		"valid":   {WebUserId: 42, ExpiresAt: time.Now().Add(OAUTH_LINK_LIFETIME)},
+		"expired": {WebUserId: 42, ExpiresAt: time.Now().Add(-time.Minute)},
+	}
+
+	t.Cleanup(func() {
+		server.Close()
+		OAUTH_AUTH_URL, OAUTH_TOKEN_URL, OAUTH_USER_URL = authURL, tokenURL, userURL
+		mapManualLinks, mapMatchReviews, oauthLinkRequests = savedLinks, savedReviews, savedRequests
+		os.Chdir(wd)
+	})
+}
+
+// Open /link/start like the player's browser does and return the state cookie it sets
+func start_link(t *testing.T, token string) *http.Cookie {
+	rec := httptest.NewRecorder()
+	handle_link_start(rec, httptest.NewRequest("GET", "/link/start?token="+token, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("/link/start returned %d, want %d", rec.Code, http.StatusFound)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == OAUTH_STATE_COOKIE {
+			return c
+		}
+	}
+	t.Fatal("/link/start set no state cookie")
+	return nil
+}
+
+func call_link_callback(state string, code string, cookie *http.Cookie) int {
+	r := httptest.NewRequest("GET", "/link/callback?code="+code+"&state="+state, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handle_link_callback(rec, r)
+	return rec.Code
+}
+
+func TestLinkCallback(t *testing.T) {
+	type callback_t struct {
+		state  string
+		code   string
+		cookie string // state the cookie was set for, "" for no cookie
+		want   int
+	}
+	tests := []struct {
+		name      string
+		callbacks []callback_t
+		linked    bool
+	}{
+		{"good callback", []callback_t{{"valid", "good-code", "valid", http.StatusOK}}, true},
+		{"unknown state", []callback_t{{"forged", "good-code", "forged", http.StatusGone}}, false},
+		{"expired state", []callback_t{{"expired", "good-code", "expired", http.StatusGone}}, false},
+		{"reused state", []callback_t{
+			{"valid", "bad-code", "valid", http.StatusBadGateway},
+			{"valid", "good-code", "valid", http.StatusGone},
+		}, false},
+		{"reused after success", []callback_t{
+			{"valid", "good-code", "valid", http.StatusOK},
+			{"valid", "good-code", "valid", http.StatusGone},
+		}, true},
+		{"no state cookie", []callback_t{{"valid", "good-code", "", http.StatusForbidden}}, false},
+		{"cookie of another link", []callback_t{{"valid", "good-code", "forged", http.StatusForbidden}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup_oauth_test(t)
+			for i, c := range tt.callbacks {
+				var cookie *http.Cookie
+				switch {
+				case c.cookie == "":
+				case oauthLinkRequests[c.cookie].WebUserId != 0 && time.Now().Before(oauthLinkRequests[c.cookie].ExpiresAt):
+					cookie = start_link(t, c.cookie)
+				default: // /link/start refuses unknown tokens, the cookie is forged too
+					cookie = &http.Cookie{Name: OAUTH_STATE_COOKIE, Value: c.cookie}
+				}
+				if got := call_link_callback(c.state, c.code, cookie); got != c.want {
+					t.Errorf("callback %d returned %d, want %d", i+1, got, c.want)
+				}
+			}
+
+			player := mapWebUserIdToPlayer[42]
+			if linked := player.Discord_id == testDiscordId; linked != tt.linked {
+				t.Errorf("player linked = %v, want %v", linked, tt.linked)
+			}
+			if _, manual := mapManualLinks[42]; manual != tt.linked {
+				t.Errorf("manual link stored = %v, want %v", manual, tt.linked)
+			}
+		})
+	}
+}
+
+func TestLinkCallbackAccountOfAnotherPlayer(t *testing.T) {
+	setup_oauth_test(t)
+	mapWebUserIdToPlayer[7] = web_player_t{WebUserId: 7, WebName: "Other", Discord_id: testDiscordId}
+
+	if got := call_link_callback("valid", "good-code", start_link(t, "valid")); got != http.StatusConflict {
+		t.Errorf("callback returned %d, want %d", got, http.StatusConflict)
+	}
+	if player := mapWebUserIdToPlayer[42]; player.Discord_id != "" {
+		t.Errorf("player was linked to %s", player.Discord_id)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// How long a dangerous command may hold the lock
+const PROMPT_LOCK_TTL time.Duration = 10 * time.Minute // waiting for the owner to answer a prompt
+const RUNNING_LOCK_TTL time.Duration = 2 * time.Hour   // role changes for every member of a large server
+
+// The dangerous command that is running or waiting for its owner, only one at a time is allowed
+// Stored in ./data/operationLock so a restart can tell that an operation was cut off
+type operation_lock_t struct {
+	Owner     string
+	Command   string
+	ChannelID string
+	Started   time.Time
+	Expires   time.Time
+	Stopping  string // why the operation was told to stop, it keeps the lock until its work returns
+}
+
+type operation_t struct {
+	operation_lock_t
+	ctx    context.Context // cancelled by /cancel, when the lock expires or on release
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+var currentOperation *operation_t
+var operationMutex sync.Mutex
+
+// Take the lock for a dangerous command, fails if another one holds it
+func start_operation(owner string, command string, channelID string, ttl time.Duration) (*operation_t, error) {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	if op := currentOperation; op != nil {
+		return nil, fmt.Errorf("%s of %s is in use since %s, see /status", op.Command, member_name(op.Owner), op.Started.Format("15:04 MST"))
+	}
+
+	op := &operation_t{operation_lock_t: operation_lock_t{
+		Owner:     owner,
+		Command:   command,
+		ChannelID: channelID,
+		Started:   time.Now().UTC(),
+		Expires:   time.Now().UTC().Add(ttl),
+	}}
+	op.ctx, op.cancel = context.WithCancel(context.Background())
+	op.timer = time.AfterFunc(ttl, func() { expire_operation(op) })
+	currentOperation = op
+	store_data(op.operation_lock_t, "operationLock")
+	log_info("operation started", log_fields{"command": command, "member": owner, "expires": op.Expires})
+	return op, nil
+}
+
+// Move the expiry, e.g. once the owner answered the prompt and the work starts
+func (op *operation_t) extend(ttl time.Duration) {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	if currentOperation != op {
+		return
+	}
+	op.timer.Reset(ttl)
+	op.Expires = time.Now().UTC().Add(ttl)
+	store_data(op.operation_lock_t, "operationLock")
+}
+
+// Free the lock once the work of the operation returned
+// Does nothing if it was already released, so a late release can't free the lock of the next operation
+func (op *operation_t) release() {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	op.timer.Stop()
+	op.cancel()
+	if currentOperation != op {
+		return
+	}
+	currentOperation = nil
+	store_data(operation_lock_t{}, "operationLock")
+	log_info("operation finished", log_fields{"command": op.Command, "member": op.Owner, "duration": time.Since(op.Started).String()})
+}
+
+// Returns the operation that holds the lock, nil if none does
+func active_operation() *operation_t {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	return currentOperation
+}
+
+// A copy of the lock of the running operation, false if nothing is running
+func operation_status() (operation_lock_t, bool) {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	if currentOperation == nil {
+		return operation_lock_t{}, false
+	}
+	return currentOperation.operation_lock_t, true
+}
+
+// Tell the operation that holds the lock to stop
+// The lock is only freed once its work returns, so nothing else starts while the current step is still running
+func cancel_operation(by string) (*operation_t, error) {
+	operationMutex.Lock()
+	op := currentOperation
+	if op == nil {
+		operationMutex.Unlock()
+		return nil, fmt.Errorf("nothing is running")
+	}
+	if op.Stopping != "" {
+		operationMutex.Unlock()
+		return nil, fmt.Errorf("%s of %s is already cancelling (%s)", op.Command, member_name(op.Owner), op.Stopping)
+	}
+	op.Stopping = "cancelled by " + member_name(by)
+	store_data(op.operation_lock_t, "operationLock")
+	operationMutex.Unlock()
+	op.cancel()
+	log_warn("operation cancelled", log_fields{"command": op.Command, "member": op.Owner, "cancelled_by": by})
+	return op, nil
+}
+
+// An owner that walks away doesn't hold the lock forever, the operation is told to stop and frees the lock when it does
+func expire_operation(op *operation_t) {
+	operationMutex.Lock()
+	expired := currentOperation == op && op.Stopping == ""
+	if expired {
+		op.Stopping = "expired"
+		store_data(op.operation_lock_t, "operationLock")
+	}
+	operationMutex.Unlock()
+	if !expired {
+		return
+	}
+	op.cancel()
+	log_warn("operation expired", log_fields{"command": op.Command, "member": op.Owner, "started": op.Started})
+	if botSession != nil {
+		_, err := botSession.ChannelMessageSend(op.ChannelID, DIFF_MSG_START+fmt.Sprintf("- %s TIMED OUT, it was started %s ago and stops after the current step", op.Command, time.Since(op.Started).Round(time.Second))+DIFF_MSG_END)
+		checkError(err)
+	}
+}
+
+// A lock that is still stored at startup belongs to an operation that was cut off by a crash or restart
+func recover_operation_lock(s *discordgo.Session) {
+	var stale operation_lock_t
+	load_data(&stale, "operationLock")
+	if stale.Command == "" {
+		return
+	}
+	store_data(operation_lock_t{}, "operationLock")
+	log_warn("found a stale operation lock", log_fields{"command": stale.Command, "member": stale.Owner, "started": stale.Started})
+	append_audit_log(audit_entry_t{
+		Actor:   "starbot",
+		Command: stale.Command,
+		Action:  "lock_recovered",
+		Target:  "operation started by " + stale.Owner + " at " + stale.Started.Format(time.RFC3339),
+		Result:  "interrupted by a restart",
+	})
+	message := fmt.Sprintf("- %s of %s (started %s) was interrupted by a restart, check its results before running it again", stale.Command, member_name(stale.Owner), stale.Started.Format(time.RFC1123))
+	_, err := s.ChannelMessageSend(stale.ChannelID, DIFF_MSG_START+message+DIFF_MSG_END)
+	checkError(err)
+}
+
+// /status
+func status_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	message := DIFF_MSG_START + "+ Nothing is running" + DIFF_MSG_END
+	if op, running := operation_status(); running && op.Stopping != "" {
+		message = fmt.Sprintf("%s- %s of %s is cancelling\n- %s, waiting for the current step to finish\n- started %s ago%s\nin <#%s>",
+			DIFF_MSG_START, op.Command, member_name(op.Owner), op.Stopping, time.Since(op.Started).Round(time.Second), DIFF_MSG_END, op.ChannelID)
+	} else if running {
+		message = fmt.Sprintf("%s+ %s of %s\n+ started %s ago, expires in %s\n+ /cancel to abort it%s\nin <#%s>",
+			DIFF_MSG_START, op.Command, member_name(op.Owner), time.Since(op.Started).Round(time.Second), time.Until(op.Expires).Round(time.Second), DIFF_MSG_END, op.ChannelID)
+	}
+	_, err := s.ChannelMessageSend(m.ChannelID, message)
+	checkError(err)
+	record_command("/status", "ok")
+}
+
+// /cancel
+func cancel_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	op, err := cancel_operation(m.Author.ID)
+	record_command("/cancel", command_outcome(err))
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /cancel ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	append_audit_log(audit_entry_t{
+		Actor:   m.Author.ID,
+		Command: "/cancel",
+		Action:  "operation_cancel",
+		Target:  op.Command + " of " + op.Owner,
+		Result:  "ok",
+	})
+	_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+fmt.Sprintf("+ Cancelling %s of %s, it stops after the current step and changes made so far are kept", op.Command, member_name(op.Owner))+DIFF_MSG_END)
+	checkError(err)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// What a member may do, every level includes the ones below it
+type permission_level_t int
+
+const (
+	PERM_EVERYONE   permission_level_t = iota
+	PERM_CAPTAIN                       // read-only and team-scoped commands, captains and coaches of a team have it too
+	PERM_PRIVILEGED                    // extra commands, nothing dangerous
+	PERM_ADMIN                         // everything, only IS_AUTHORIZED_AS_ADMIN so the approval of a second admin can't be granted away
+)
+
+var PERMISSION_LEVEL_NAMES = map[permission_level_t]string{
+	PERM_EVERYONE:   "everyone",
+	PERM_CAPTAIN:    "captain",
+	PERM_PRIVILEGED: "privileged",
+	PERM_ADMIN:      "admin",
+}
+
+var mapUserPermissions = map[string]permission_level_t{}    // [discord id]level granted with /perm grant
+var mapRolePermissions = map[string]permission_level_t{}    // [role id]level of every member with the role
+var mapCommandPermissions = map[string]permission_level_t{} // [command]level, overrides COMMAND_PERMISSIONS
+
+const PERM_COMMAND_USAGE string = `/perm list
+/perm grant <@member|@role|id> <captain|privileged>
+/perm revoke <@member|@role|id>
+/perm command </command> <everyone|captain|privileged|admin|default>`
+
+func parse_permission_level(name string) (permission_level_t, error) {
+	for level, n := range PERMISSION_LEVEL_NAMES {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return PERM_EVERYONE, fmt.Errorf("%s is not a permission level", name)
+}
+
+// Level a command needs, the override of /perm command wins over the default
+func command_permission(command string) permission_level_t {
+	if level, ok := mapCommandPermissions[command]; ok {
+		return level
+	}
+	return COMMAND_PERMISSIONS[command]
+}
+
+// The highest level of a member from the hardcoded lists, their grant and the grants of their roles
+func permission_level(userID string, roles []string) permission_level_t {
+	if IS_AUTHORIZED_AS_ADMIN[userID] {
+		return PERM_ADMIN
+	}
+	level := mapUserPermissions[userID]
+	if IS_PRIVILEGED_USER[userID] && level < PERM_PRIVILEGED {
+		level = PERM_PRIVILEGED
+	}
+	for _, r := range roles {
+		if mapRolePermissions[r] > level {
+			level = mapRolePermissions[r]
+		}
+	}
+	if level < PERM_CAPTAIN && len(led_teams(userID, roles)) > 0 {
+		level = PERM_CAPTAIN
+	}
+	return level
+}
+
+// Level of a member of the server, roles are looked up in the member cache
+func member_permission_level(s *discordgo.Session, userID string) permission_level_t {
+	var roles []string
+	if member, err := get_guild_member(s, userID); err == nil {
+		roles = member.Roles
+	}
+	return permission_level(userID, roles)
+}
+
+// Whether the author of the message may run command, messages in the server carry the roles of their author
+func is_authorized(s *discordgo.Session, m *discordgo.MessageCreate, command string) bool {
+	required := command_permission(command)
+	if required == PERM_EVERYONE {
+		return true
+	}
+	if m.Member != nil && m.GuildID == DISCORD_SERVER_ID {
+		return permission_level(m.Author.ID, m.Member.Roles) >= required
+	}
+	return member_permission_level(s, m.Author.ID) >= required
+}
+
+// Whether a user may run command, for buttons and select menus
+func user_is_authorized(s *discordgo.Session, userID string, command string) bool {
+	required := command_permission(command)
+	return required == PERM_EVERYONE || member_permission_level(s, userID) >= required
+}
+
+// Answer a command that the author may not run
+func send_not_authorized(s *discordgo.Session, m *discordgo.MessageCreate, command string) {
+	_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- "+command+" ERROR: "+m.Author.Username+" IS NOT AUTHORIZED"+DIFF_MSG_END)
+	checkError(err)
+}
+
+// /perm list|grant|revoke|command
+func perm_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	args := strings.Fields(strings.TrimPrefix(m.Content, "/perm"))
+	var err error
+	var message string
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		message = render_permissions(s)
+	case len(args) == 3 && args[0] == "grant":
+		message, err = grant_permission(s, m.Author.ID, args[1], args[2])
+	case len(args) == 2 && args[0] == "revoke":
+		message, err = grant_permission(s, m.Author.ID, args[1], PERMISSION_LEVEL_NAMES[PERM_EVERYONE])
+	case len(args) == 3 && args[0] == "command":
+		message, err = override_command_permission(m.Author.ID, args[1], args[2])
+	default:
+		err = fmt.Errorf("usage:\n%s", PERM_COMMAND_USAGE)
+	}
+
+	record_command("/perm", command_outcome(err))
+	if err != nil {
+		message = DIFF_MSG_START + "- /perm ERROR: " + err.Error() + DIFF_MSG_END
+	}
+	send_quiet_message(s, m.ChannelID, message)
+}
+
+// Set the level of a member or role, PERM_EVERYONE revokes the grant
+func grant_permission(s *discordgo.Session, adminID string, target string, levelName string) (string, error) {
+	level, err := parse_permission_level(levelName)
+	if err != nil {
+		return "", err
+	}
+	if level == PERM_ADMIN {
+		return "", fmt.Errorf("admins are set in IS_AUTHORIZED_AS_ADMIN, so a single admin can't grant away the approval of a second one")
+	}
+
+	grants := mapUserPermissions
+	file := "mapUserPermissions"
+	name := target
+	if roleID, roleName, ok := parse_role_argument(s, target); ok {
+		grants, file, target = mapRolePermissions, "mapRolePermissions", roleID
+		name = "role " + roleName
+	} else if discordId, ok := parse_member_argument(target); ok {
+		target = discordId
+		name = member_name(discordId)
+	} else {
+		return "", fmt.Errorf("%s is not a member or role mention or id", target)
+	}
+
+	before := grants[target]
+	if level == PERM_EVERYONE {
+		delete(grants, target)
+	} else {
+		grants[target] = level
+	}
+	err = store_data(grants, file)
+
+	action := "perm_grant"
+	if level == PERM_EVERYONE {
+		action = "perm_revoke"
+	}
+	append_audit_log(audit_entry_t{
+		Actor:   adminID,
+		Command: "/perm",
+		Action:  action,
+		Target:  name + " (" + target + ")",
+		Before:  PERMISSION_LEVEL_NAMES[before],
+		After:   PERMISSION_LEVEL_NAMES[level],
+		Result:  audit_result(err),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not store the grant, it only lasts until the bot restarts: %w", err)
+	}
+	return fmt.Sprintf("%s+ /perm DONE\n+ %s: %s -> %s%s", DIFF_MSG_START, name, PERMISSION_LEVEL_NAMES[before], PERMISSION_LEVEL_NAMES[level], DIFF_MSG_END), nil
+}
+
+// Change the level a command needs, "default" removes the override
+// Admin commands stay admin commands, for the same reason admins can't be granted
+func override_command_permission(adminID string, command string, levelName string) (string, error) {
+	if !strings.HasPrefix(command, "/") {
+		command = "/" + command
+	}
+	if _, known := COMMAND_PERMISSIONS[command]; !known {
+		return "", fmt.Errorf("%s is not a command with a permission level", command)
+	}
+	if COMMAND_PERMISSIONS[command] == PERM_ADMIN {
+		return "", fmt.Errorf("%s is an admin command and can't be overridden", command)
+	}
+	before := command_permission(command)
+	if strings.EqualFold(levelName, "default") {
+		delete(mapCommandPermissions, command)
+	} else {
+		level, err := parse_permission_level(levelName)
+		if err != nil {
+			return "", err
+		}
+		mapCommandPermissions[command] = level
+	}
+	err := store_data(mapCommandPermissions, "mapCommandPermissions")
+	after := command_permission(command)
+
+	append_audit_log(audit_entry_t{
+		Actor:   adminID,
+		Command: "/perm",
+		Action:  "perm_command",
+		Target:  command,
+		Before:  PERMISSION_LEVEL_NAMES[before],
+		After:   PERMISSION_LEVEL_NAMES[after],
+		Result:  audit_result(err),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not store the command level, it only lasts until the bot restarts: %w", err)
+	}
+	return fmt.Sprintf("%s+ /perm DONE\n+ %s: %s -> %s%s", DIFF_MSG_START, command, PERMISSION_LEVEL_NAMES[before], PERMISSION_LEVEL_NAMES[after], DIFF_MSG_END), nil
+}
+
+// Returns the id and name of the role a role mention or plain role id refers to
+// Roles that were deleted since they got a grant are still found, so the grant can be revoked
+func parse_role_argument(s *discordgo.Session, arg string) (string, string, bool) {
+	id := arg
+	if strings.HasPrefix(arg, "<@&") && strings.HasSuffix(arg, ">") {
+		id = strings.TrimSuffix(strings.TrimPrefix(arg, "<@&"), ">")
+	}
+	roles, err := s.GuildRoles(DISCORD_SERVER_ID)
+	checkError(err)
+	for _, r := range roles {
+		if r.ID == id {
+			return r.ID, r.Name, true
+		}
+	}
+	if _, granted := mapRolePermissions[id]; granted {
+		return id, "deleted role", true
+	}
+	return "", "", false
+}
+
+// Every grant and every command level for /perm list
+func render_permissions(s *discordgo.Session) string {
+	var lines []string
+	for id := range IS_AUTHORIZED_AS_ADMIN {
+		lines = append(lines, fmt.Sprintf("<@%s> admin (hardcoded)", id))
+	}
+	for id := range IS_PRIVILEGED_USER {
+		lines = append(lines, fmt.Sprintf("<@%s> privileged (hardcoded)", id))
+	}
+	for id, level := range mapUserPermissions {
+		lines = append(lines, fmt.Sprintf("<@%s> %s", id, PERMISSION_LEVEL_NAMES[level]))
+	}
+	for id, level := range mapRolePermissions {
+		lines = append(lines, fmt.Sprintf("<@&%s> %s (every member with the role)", id, PERMISSION_LEVEL_NAMES[level]))
+	}
+	sort.Strings(lines)
+	message := "**Grants**\n" + strings.Join(lines, "\n")
+
+	var commands []string
+	for command := range COMMAND_PERMISSIONS {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	message += "\n**Commands**\n"
+	for _, command := range commands {
+		line := fmt.Sprintf("`%s` %s", command, PERMISSION_LEVEL_NAMES[command_permission(command)])
+		if _, ok := mapCommandPermissions[command]; ok {
+			line += " (overridden, default " + PERMISSION_LEVEL_NAMES[COMMAND_PERMISSIONS[command]] + ")"
+		}
+		message += line + "\n"
+	}
+	return message
+}
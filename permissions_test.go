@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPermissionLevel(t *testing.T) {
+	var admin, privileged string
+	for id := range IS_AUTHORIZED_AS_ADMIN {
+		admin = id
+	}
+	for id := range IS_PRIVILEGED_USER {
+		privileged = id
+	}
+	use_test_permissions(t,
+		map[string]permission_level_t{"600": PERM_CAPTAIN, "601": PERM_PRIVILEGED, admin: PERM_CAPTAIN, privileged: PERM_CAPTAIN},
+		map[string]permission_level_t{"2001": PERM_PRIVILEGED, "2002": PERM_CAPTAIN},
+		map[string]permission_level_t{},
+	)
+	use_test_teams(t, registered_team_t{Name: "Team 1", Role_id: "1001", Captain_id: "700"})
+	use_test_roster(t, web_player_t{WebUserId: 1, WebName: "Coach", Team: "Team 1", Discord_id: "701", Helper_role: []int{WEB_HELPER_COACH}})
+
+	tests := []struct {
+		name   string
+		userID string
+		roles  []string
+		want   permission_level_t
+	}{
+		{"admin", admin, nil, PERM_ADMIN},
+		{"admin with a lower grant", admin, []string{"2002"}, PERM_ADMIN},
+		{"hardcoded privileged user", privileged, nil, PERM_PRIVILEGED},
+		{"captain grant", "600", nil, PERM_CAPTAIN},
+		{"privileged grant", "601", nil, PERM_PRIVILEGED},
+		{"role grant", "602", []string{"2001"}, PERM_PRIVILEGED},
+		{"highest of user and role grants", "600", []string{"2001", "2002"}, PERM_PRIVILEGED},
+		{"role without a grant", "602", []string{"2003"}, PERM_EVERYONE},
+		{"captain of a team", "700", nil, PERM_CAPTAIN},
+		{"coach in the WebApp", "701", nil, PERM_CAPTAIN},
+		{"captain with a privileged role", "700", []string{"2001"}, PERM_PRIVILEGED},
+		{"nobody", "800", nil, PERM_EVERYONE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permission_level(tt.userID, tt.roles); got != tt.want {
+				t.Errorf("permission_level() = %s, want %s", PERMISSION_LEVEL_NAMES[got], PERMISSION_LEVEL_NAMES[tt.want])
+			}
+		})
+	}
+}
+
+func TestCommandPermission(t *testing.T) {
+	use_test_permissions(t, map[string]permission_level_t{}, map[string]permission_level_t{}, map[string]permission_level_t{"/show": PERM_CAPTAIN})
+
+	tests := []struct {
+		command string
+		want    permission_level_t
+	}{
+		{"/show", PERM_CAPTAIN},
+		{"/roster", COMMAND_PERMISSIONS["/roster"]},
+		{"/perm", PERM_ADMIN},
+		{"/unknown", PERM_EVERYONE},
+	}
+	for _, tt := range tests {
+		if got := command_permission(tt.command); got != tt.want {
+			t.Errorf("command_permission(%s) = %s, want %s", tt.command, PERMISSION_LEVEL_NAMES[got], PERMISSION_LEVEL_NAMES[tt.want])
+		}
+	}
+}
+
+func TestParsePermissionLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    permission_level_t
+		wantErr bool
+	}{
+		{"everyone", PERM_EVERYONE, false},
+		{"Captain", PERM_CAPTAIN, false},
+		{"PRIVILEGED", PERM_PRIVILEGED, false},
+		{"admin", PERM_ADMIN, false},
+		{"moderator", PERM_EVERYONE, true},
+		{"", PERM_EVERYONE, true},
+	}
+	for _, tt := range tests {
+		got, err := parse_permission_level(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parse_permission_level(%q) = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
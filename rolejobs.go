@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Number of members whose roles are changed at the same time
+// discordgo queues requests per rate-limit bucket (and waits out 429s), so this only bounds how many buckets are busy at once
+const ROLE_WORKERS int = 8
+
+// The progress message is edited at most this often, editing is rate limited too
+const PROGRESS_EDIT_INTERVAL time.Duration = 3 * time.Second
+
+// Role changes for a single member
+type role_job_t struct {
+	Name      string // roster name of the member
+	DiscordId string
+	Run       func() ([]string, error) // makes the changes, returns a line per added/removed role
+}
+
+// What happened to a single member, one line of the downloadable report
+type member_report_t struct {
+	Name      string
+	DiscordId string
+	Status    string // "changed", "unchanged", "skipped" or "failed"
+	Changes   []string
+	Error     string
+}
+
+// A single message that shows the progress of a long running command, edited in place
+type progress_message_t struct {
+	mutex     sync.Mutex
+	s         *discordgo.Session
+	channelID string
+	messageID string
+	title     string
+	total     int
+	processed int
+	failed    int
+	started   time.Time
+	lastEdit  time.Time
+}
+
+func new_progress_message(s *discordgo.Session, channelID string, title string, total int) *progress_message_t {
+	p := &progress_message_t{s: s, channelID: channelID, title: title, total: total, started: time.Now()}
+	msg, err := s.ChannelMessageSend(channelID, p.render())
+	checkError(err)
+	if err == nil {
+		p.messageID = msg.ID
+	}
+	p.lastEdit = time.Now()
+	return p
+}
+
+func (p *progress_message_t) render() string {
+	message := fmt.Sprintf("+ %s %d/%d members processed, %d failures", p.title, p.processed, p.total, p.failed)
+	switch {
+	case p.processed == p.total:
+		message += fmt.Sprintf(", done in %s", time.Since(p.started).Round(time.Second))
+	case p.processed > 0:
+		perMember := time.Since(p.started) / time.Duration(p.processed)
+		eta := perMember * time.Duration(p.total-p.processed)
+		message += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return FIX_MSG_START + message + FIX_MSG_END
+}
+
+// Count a finished member, the message is only edited every PROGRESS_EDIT_INTERVAL and at the end
+func (p *progress_message_t) done(failed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.processed++
+	if failed {
+		p.failed++
+	}
+	if p.processed < p.total && time.Since(p.lastEdit) < PROGRESS_EDIT_INTERVAL {
+		return
+	}
+	p.lastEdit = time.Now()
+	if p.messageID == "" {
+		return
+	}
+	_, err := p.s.ChannelMessageEdit(p.channelID, p.messageID, p.render())
+	checkError(err)
+}
+
+// Run the jobs on ROLE_WORKERS workers while a single progress message is kept up to date
+// Every member that was changed (or failed) is recorded in the audit log on behalf of actorID
+// Once ctx is cancelled the remaining jobs are reported as skipped instead of run
+// Returns a report per job, in no particular order
+func run_role_jobs(ctx context.Context, s *discordgo.Session, channelID string, actorID string, title string, jobs []role_job_t) []member_report_t {
+	progress := new_progress_message(s, channelID, title, len(jobs))
+	queue := make(chan role_job_t)
+	results := make(chan member_report_t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < ROLE_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				report := member_report_t{Name: job.Name, DiscordId: job.DiscordId, Status: "unchanged"}
+				if ctx.Err() != nil {
+					report.Status = "skipped"
+					report.Error = "cancelled"
+					progress.done(false)
+					results <- report
+					continue
+				}
+				changes, err := job.Run()
+				report.Changes = changes
+				if len(changes) > 0 {
+					report.Status = "changed"
+				}
+				if err != nil {
+					report.Status = "failed"
+					report.Error = err.Error()
+					log_warn("role change failed", log_fields{"command": title, "guild": DISCORD_SERVER_ID, "member": job.DiscordId, "error": err})
+				}
+				if report.Status != "unchanged" {
+					append_audit_log(audit_entry_t{
+						Actor:   actorID,
+						Command: title,
+						Action:  "member_roles",
+						Target:  fmt.Sprintf("%s (%s)", job.Name, job.DiscordId),
+						After:   strings.Join(changes, " "),
+						Result:  report_result(report),
+					})
+				}
+				progress.done(err != nil)
+				results <- report
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	var reports []member_report_t
+	for r := range results {
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+func report_result(r member_report_t) string {
+	if r.Error != "" {
+		return r.Error
+	}
+	return "ok"
+}
+
+// Counts of the report by status
+func count_reports(reports []member_report_t) map[string]int {
+	counts := make(map[string]int)
+	for _, r := range reports {
+		counts[r.Status]++
+		counts["roles"] += len(r.Changes)
+	}
+	return counts
+}
+
+// Post the final summary of a role command with the per-member report attached as CSV
+func send_role_report(s *discordgo.Session, channelID string, command string, summary string, reports []member_report_t) {
+	sort.Slice(reports, func(i, j int) bool { return strings.ToLower(reports[i].Name) < strings.ToLower(reports[j].Name) })
+
+	var buffer bytes.Buffer
+	w := csv.NewWriter(&buffer)
+	err := w.Write([]string{"name", "discord_id", "status", "changes", "error"})
+	checkError(err)
+	for _, r := range reports {
+		err = w.Write([]string{r.Name, r.DiscordId, r.Status, strings.Join(r.Changes, " "), r.Error})
+		checkError(err)
+	}
+	w.Flush()
+	checkError(w.Error())
+
+	counts := count_reports(reports)
+	message := DIFF_MSG_START
+	if counts["failed"] > 0 {
+		message += fmt.Sprintf("- %s FINISHED WITH %d FAILURES\n", command, counts["failed"])
+	} else {
+		message += "+ " + command + " DONE\n"
+	}
+	message += fmt.Sprintf("+ %d members changed, %d unchanged, %d skipped, %d roles added or removed\n", counts["changed"], counts["unchanged"], counts["skipped"], counts["roles"])
+	message += DIFF_MSG_END + summary
+
+	fileName := strings.TrimPrefix(command, "/") + "-" + time.Now().UTC().Format("20060102-150405") + ".csv"
+	_, err = s.ChannelFileSendWithMessage(channelID, message, fileName, &buffer)
+	checkError(err)
+}
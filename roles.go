@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord role for each race key used by the WebApp (declared weekly and race picker have no role)
+var WEB_RACE_ROLE_IDS = map[int]string{
+	6: PROTOSS_ROLE_ID,
+	7: ZERG_ROLE_ID,
+	8: TERRAN_ROLE_ID,
+}
+
+// Discord role for each tier used by the WebApp (999 = no tier)
+var WEB_TIER_ROLE_IDS = map[int]string{
+	0: TIER0_ROLE_ID,
+	1: TIER1_ROLE_ID,
+	2: TIER2_ROLE_ID,
+	3: TIER3_ROLE_ID,
+}
+
+// Helper role keys used by the WebApp
+const WEB_HELPER_COACH int = 5
+const WEB_HELPER_ASSISTANT_COACH int = 6
+
+// Discord role for each helper role key used by the WebApp
+var WEB_HELPER_ROLE_IDS = map[int]string{
+	WEB_HELPER_COACH:           COACH_ROLE_ID,
+	WEB_HELPER_ASSISTANT_COACH: ASST_COACH_ROLE_ID,
+}
+
+// Bring the race, tier, team and helper roles of a single member in line with their roster entry
+// Returns a line for every role that was added or removed
+func sync_player_roles(s *discordgo.Session, player web_player_t) ([]string, error) {
+	if player.Discord_id == "" {
+		return nil, fmt.Errorf("%s is not linked to a discord account", player.WebName)
+	}
+	return apply_member_roles(s, player.Discord_id, desired_player_roles(player))
+}
+
+// Add (true) or remove (false) the given roles of a member, only roles that differ cost a REST call
+// Every role is tried even if one fails, the first error is returned
+func apply_member_roles(s *discordgo.Session, discordId string, desired map[string]bool) ([]string, error) {
+	member, err := get_guild_member(s, discordId)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	var firstErr error
+	for roleID, add := range role_changes(member, desired) {
+		if add {
+			err = s.GuildMemberRoleAdd(DISCORD_SERVER_ID, discordId, roleID)
+			metricRoleMutations.inc("add", command_outcome(err))
+			if err == nil {
+				changes = append(changes, "+"+managed_role_name(roleID))
+			}
+		} else {
+			err = s.GuildMemberRoleRemove(DISCORD_SERVER_ID, discordId, roleID)
+			metricRoleMutations.inc("remove", command_outcome(err))
+			if err == nil {
+				changes = append(changes, "-"+managed_role_name(roleID))
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", managed_role_name(roleID), err)
+		}
+	}
+	return changes, firstErr
+}
+
+// The roles that have to be added (true) or removed (false) to give a member the desired roles
+func role_changes(member *discordgo.Member, desired map[string]bool) map[string]bool {
+	hasRole := make(map[string]bool)
+	for _, r := range member.Roles {
+		hasRole[r] = true
+	}
+	changes := make(map[string]bool)
+	for roleID, want := range desired {
+		if want != hasRole[roleID] {
+			changes[roleID] = want
+		}
+	}
+	return changes
+}
+
+// Count the role changes /assignroles would make, without making them
+func plan_roster_role_changes(s *discordgo.Session) (roles int, members int, err error) {
+	for _, player := range all_web_players() {
+		if player.Discord_id == "" || player.Left_server {
+			continue
+		}
+		member, err := get_guild_member(s, player.Discord_id)
+		if err != nil {
+			if is_not_found(err) { // left without us noticing, /assignroles reports it
+				continue
+			}
+			return 0, 0, err
+		}
+		if changes := len(role_changes(member, desired_player_roles(player))); changes > 0 {
+			roles += changes
+			members++
+		}
+	}
+	return roles, members, nil
+}
+
+// Returns the roster roles a player should (true) and should not (false) have
+// Roles that are not in the map are left alone, e.g. race roles of race pickers
+func desired_player_roles(player web_player_t) map[string]bool {
+	managed := make(map[string]bool)
+	if _, ok := WEB_RACE_ROLE_IDS[player.Race]; ok { // leave race roles alone for race pickers
+		for race, roleID := range WEB_RACE_ROLE_IDS {
+			managed[roleID] = race == player.Race
+		}
+	}
+	if VALID_WEB_TIERS[player.Tier] {
+		for tier, roleID := range WEB_TIER_ROLE_IDS {
+			managed[roleID] = tier == player.Tier
+		}
+	}
+	if team, ok := resolve_team(player.Team); ok || player.Team == "" { // leave team roles alone for unknown teams
+		for _, t := range active_teams() {
+			managed[t.Role_id] = t.Role_id == team.Role_id
+		}
+	}
+	for _, roleID := range WEB_HELPER_ROLE_IDS {
+		managed[roleID] = false
+	}
+	for _, helper := range player.Helper_role {
+		if roleID, ok := WEB_HELPER_ROLE_IDS[helper]; ok {
+			managed[roleID] = true
+		}
+	}
+	if is_appointed_assistant_coach(player) { // appointed by their captain or coach with /myteam
+		managed[ASST_COACH_ROLE_ID] = true
+	}
+	return managed
+}
+
+// Human readable name of a role managed by sync_player_roles (so staff notices don't ping whole teams)
+func managed_role_name(roleID string) string {
+	for race, id := range WEB_RACE_ROLE_IDS {
+		if id == roleID {
+			return WEB_RACE_NAMES[race]
+		}
+	}
+	for tier, id := range WEB_TIER_ROLE_IDS {
+		if id == roleID {
+			return tier_name(tier)
+		}
+	}
+	if team, ok := get_registered_team(roleID); ok {
+		return team.Name
+	}
+	switch roleID {
+	case COACH_ROLE_ID:
+		return "Coach"
+	case ASST_COACH_ROLE_ID:
+		return "Assistant Coach"
+	}
+	return roleID
+}
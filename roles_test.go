@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRoleChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		has     []string
+		desired map[string]bool
+		want    map[string]bool
+	}{
+		{"nothing to do", []string{"1", "2"}, map[string]bool{"1": true, "3": false}, map[string]bool{}},
+		{"add", []string{"1"}, map[string]bool{"1": true, "2": true}, map[string]bool{"2": true}},
+		{"remove", []string{"1", "2"}, map[string]bool{"2": false}, map[string]bool{"2": false}},
+		{"swap", []string{"1"}, map[string]bool{"1": false, "2": true}, map[string]bool{"1": false, "2": true}},
+		{"unmanaged roles stay", []string{"1", "9"}, map[string]bool{"1": false}, map[string]bool{"1": false}},
+		{"no roles", nil, map[string]bool{"1": true}, map[string]bool{"1": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := role_changes(&discordgo.Member{Roles: tt.has}, tt.desired)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("role_changes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
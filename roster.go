@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+)
+
+// Guards the roster: mapWebUserIdToPlayer, mapWebUserNameToWebUserId, mapManualLinks, mapMatchReviews and mapMatchDecisions
+// Discord handlers, the role workers and the HTTP handlers use them at the same time, so every access goes through
+// the functions below or holds the lock itself (and then must not call them, the lock isn't reentrant)
+var rosterMutex sync.RWMutex
+
+// Returns a player of the roster by WebApp id
+func get_web_player(webId int) (web_player_t, bool) {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	player, ok := mapWebUserIdToPlayer[webId]
+	return player, ok
+}
+
+// Returns the WebApp id of a web name (exact match)
+func get_web_id_by_name(name string) (int, bool) {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	webId, ok := mapWebUserNameToWebUserId[name]
+	return webId, ok
+}
+
+// A copy of every player of the roster, safe to range over while the roster changes
+func all_web_players() []web_player_t {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	players := make([]web_player_t, 0, len(mapWebUserIdToPlayer))
+	for _, p := range mapWebUserIdToPlayer {
+		players = append(players, p)
+	}
+	return players
+}
+
+// A copy of the roster by WebApp id
+func copy_web_players() map[int]web_player_t {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	players := make(map[int]web_player_t, len(mapWebUserIdToPlayer))
+	for id, p := range mapWebUserIdToPlayer {
+		players[id] = p
+	}
+	return players
+}
+
+func count_web_players() int {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	return len(mapWebUserIdToPlayer)
+}
+
+// Change a single player in memory, store_roster persists it
+// Returns the changed player, false if the player is not on the roster
+func update_web_player(webId int, change func(p *web_player_t)) (web_player_t, bool) {
+	rosterMutex.Lock()
+	defer rosterMutex.Unlock()
+	player, ok := mapWebUserIdToPlayer[webId]
+	if !ok {
+		return player, false
+	}
+	change(&player)
+	mapWebUserIdToPlayer[webId] = player
+	mapWebUserNameToWebUserId[player.WebName] = webId
+	return player, true
+}
+
+// Store a fresh WebApp record of a single player, keeping what only the bot knows about them
+func merge_web_player(player web_player_t) (web_player_t, error) {
+	rosterMutex.Lock()
+	defer rosterMutex.Unlock()
+	if old, ok := mapWebUserIdToPlayer[player.WebUserId]; ok {
+		player = keep_local_player_fields(player, old)
+	}
+	mapWebUserIdToPlayer[player.WebUserId] = player
+	mapWebUserNameToWebUserId[player.WebName] = player.WebUserId
+	return player, store_roster_locked()
+}
+
+// Persist the roster maps in ./data
+func store_roster() error {
+	rosterMutex.Lock()
+	defer rosterMutex.Unlock()
+	return store_roster_locked()
+}
+
+func store_roster_locked() error {
+	err := store_data(mapWebUserNameToWebUserId, "mapWebUserNameToWebUserId")
+	if err == nil {
+		err = store_data(mapWebUserIdToPlayer, "mapWebUserIdToPlayer")
+	}
+	return err
+}
+
+// Returns the link an admin made for a web player
+func get_manual_link(webId int) (manual_link_t, bool) {
+	rosterMutex.RLock()
+	defer rosterMutex.RUnlock()
+	link, ok := mapManualLinks[webId]
+	return link, ok
+}
+
+// Drop the pending match review of a web player, e.g. once they were found
+func forget_match_review(webId int) {
+	rosterMutex.Lock()
+	defer rosterMutex.Unlock()
+	if _, ok := mapMatchReviews[webId]; ok {
+		delete(mapMatchReviews, webId)
+		store_data(mapMatchReviews, "mapMatchReviews")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Human readable names of the helper role keys used by the WebApp
+var WEB_HELPER_ROLE_NAMES = map[int]string{
+	4:                          "Player",
+	WEB_HELPER_COACH:           "Coach",
+	WEB_HELPER_ASSISTANT_COACH: "Assistant Coach",
+}
+
+// Embed color of /show (decimal value of hex color code)
+const SHOW_EMBED_COLOR int = NEON_GREEN
+
+const SHOW_COMMAND_USAGE string = "usage /show <@mention | discord id | web id | partial name>"
+
+// Quote what a user typed for a reply, so markdown in it stays plain text
+func quote_query(query string) string {
+	return "`" + strings.ReplaceAll(query, "`", "'") + "`"
+}
+
+// Returns every player matching a mention, discord id, WebApp id or (partial) web/discord name
+// A single exact match wins over partial matches
+func lookup_players(query string) []web_player_t {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil
+	}
+	if discordId, ok := parse_member_argument(query); ok {
+		if webId, found := get_web_id_by_discord_id(discordId); found {
+			if player, ok := get_web_player(webId); ok {
+				return []web_player_t{player}
+			}
+		}
+		return nil
+	}
+	if id, err := strconv.Atoi(query); err == nil {
+		if player, ok := get_web_player(id); ok {
+			return []web_player_t{player}
+		}
+	}
+
+	var exact, partial []web_player_t
+	q := strings.ToLower(query)
+	for _, p := range all_web_players() {
+		webName := strings.ToLower(p.WebName)
+		discordName := strings.ToLower(strip_discriminator(p.DiscordName))
+		switch {
+		case webName == q || discordName == q:
+			exact = append(exact, p)
+		case strings.Contains(webName, q) || strings.Contains(discordName, q):
+			partial = append(partial, p)
+		}
+	}
+	if len(exact) == 1 {
+		return exact
+	}
+	matches := append(exact, partial...)
+	sort.Slice(matches, func(i, j int) bool { return strings.ToLower(matches[i].WebName) < strings.ToLower(matches[j].WebName) })
+	return matches
+}
+
+// /show <@mention | discord id | web id | partial name>
+func show_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	query := strings.TrimSpace(strings.TrimPrefix(m.Content, "/show"))
+	if query == "" {
+		record_command("/show", "usage")
+		_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /show ERROR: "+SHOW_COMMAND_USAGE+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	players := lookup_players(query)
+	if len(players) == 0 {
+		record_command("/show", "not_found")
+	} else {
+		record_command("/show", "ok")
+	}
+
+	switch {
+	case len(players) == 0:
+		send_quiet_message(s, m.ChannelID, quote_query(query)+" not found")
+	case len(players) == 1:
+		_, err := s.ChannelMessageSendEmbed(m.ChannelID, player_profile_embed(s, players[0]))
+		checkError(err)
+	default:
+		message := fmt.Sprintf("**%d players match %s**, choose one:", len(players), quote_query(query))
+		if len(players) > 25 {
+			message = fmt.Sprintf("**%d players match %s**, the first 25 are listed, narrow the search or use the WebApp id:", len(players), quote_query(query))
+		}
+		_, err := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content:         message,
+			Components:      player_select_menu(component_id("show", m.Author.ID, COMPONENT_TTL), players),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		checkError(err)
+	}
+}
+
+// The player chosen from the select menu of an ambiguous /show
+func handle_show_component(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if _, ok := authorize_component(s, i); !ok {
+		return
+	}
+	values := i.MessageComponentData().Values
+	if len(values) == 0 {
+		return
+	}
+	webId, _ := strconv.Atoi(values[0])
+	player, ok := get_web_player(webId)
+	if !ok {
+		respond_update(s, i, "Player "+values[0]+" is no longer on the roster")
+		return
+	}
+	respond_update(s, i, "", player_profile_embed(s, player))
+}
+
+// Build the profile embed of a player
+func player_profile_embed(s *discordgo.Session, p web_player_t) *discordgo.MessageEmbed {
+	discord := "not linked"
+	if p.Discord_id != "" {
+		discord = fmt.Sprintf("<@%s>\n`%s`", p.Discord_id, p.Discord_id)
+		if p.Left_server {
+			discord += "\nleft the server " + p.Left_at.Format("2006-01-02")
+		}
+	}
+
+	var helpers []string
+	for _, h := range p.Helper_role {
+		if name, ok := WEB_HELPER_ROLE_NAMES[h]; ok {
+			helpers = append(helpers, name)
+		}
+	}
+	if len(helpers) == 0 {
+		helpers = append(helpers, "none")
+	}
+
+	waitlist := "no"
+	if p.In_waitlist {
+		waitlist = "yes"
+	}
+	timezone := p.Timezone
+	if timezone == "" {
+		timezone = "unknown"
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       p.WebName,
+		Description: "Discord name: `" + p.DiscordName + "`",
+		Color:       SHOW_EMBED_COLOR,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Discord", Value: discord, Inline: true},
+			{Name: "Team", Value: team_or_none(p.Team), Inline: true},
+			{Name: "Tier", Value: tier_name(p.Tier), Inline: true},
+			{Name: "Race", Value: race_name(p.Race), Inline: true},
+			{Name: "MMR", Value: strconv.Itoa(p.Mmr), Inline: true},
+			{Name: "Elo", Value: strconv.Itoa(p.Elo), Inline: true},
+			{Name: "W/L/T", Value: fmt.Sprintf("%d/%d/%d", p.Wins, p.Losses, p.Ties), Inline: true},
+			{Name: "Timezone", Value: timezone, Inline: true},
+			{Name: "Waitlist", Value: waitlist, Inline: true},
+			{Name: "Helper roles", Value: strings.Join(helpers, ", ")},
+			{Name: "Role check", Value: player_role_check(s, p)},
+		},
+		Footer: &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("WebApp id %d", p.WebUserId)},
+	}
+}
+
+// Compare the discord roles of a player with the roles their roster entry asks for
+func player_role_check(s *discordgo.Session, p web_player_t) string {
+	if p.Discord_id == "" || p.Left_server {
+		return "not on the server"
+	}
+	member, err := get_guild_member(s, p.Discord_id)
+	if err != nil {
+		return "could not load member: " + err.Error()
+	}
+	hasRole := make(map[string]bool)
+	for _, r := range member.Roles {
+		hasRole[r] = true
+	}
+
+	var missing, unexpected []string
+	for roleID, want := range desired_player_roles(p) {
+		switch {
+		case want && !hasRole[roleID]:
+			missing = append(missing, managed_role_name(roleID))
+		case !want && hasRole[roleID]:
+			unexpected = append(unexpected, managed_role_name(roleID))
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return "✅ discord roles match the roster"
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	result := "⚠️ discord roles differ from the roster"
+	if len(missing) > 0 {
+		result += "\nmissing: " + strings.Join(missing, ", ")
+	}
+	if len(unexpected) > 0 {
+		result += "\nunexpected: " + strings.Join(unexpected, ", ")
+	}
+	return result
+}
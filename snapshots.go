@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// How many snapshots are kept, the oldest are removed when a new one is taken
+const SNAPSHOT_RETENTION int = 20
+
+// The role state of the whole guild at one point in time, stored in ./data/snapshot-<Id>
+type role_snapshot_t struct {
+	Id            string
+	Created_by    string // discord id of the admin, "starbot" for automatic snapshots
+	Created_at    time.Time
+	Reason        string
+	Roles         []discordgo.Role
+	Members       map[string][]string // [discord id]role ids
+	Member_names  map[string]string   // [discord id]username#discriminator
+	Restored_role map[string]string   // [role id in the snapshot]id of the role recreated by /snapshot restore
+}
+
+// How the live guild differs from a snapshot
+type snapshot_diff_t struct {
+	Deleted_roles []discordgo.Role // in the snapshot, gone now
+	Created_roles []*discordgo.Role
+	Changed_roles []string // a line per role whose definition changed
+	Members       []member_role_diff_t
+	Left          []string // discord ids of members that left the server
+}
+
+// Roles a member gained (Added) or lost (Removed) since the snapshot, as role ids of the snapshot
+type member_role_diff_t struct {
+	DiscordId string
+	Name      string
+	Added     []string
+	Removed   []string
+}
+
+func snapshot_file(id string) string {
+	return "snapshot-" + id
+}
+
+// Capture every role and the roles of every member
+func create_role_snapshot(s *discordgo.Session, authorID string, reason string) (role_snapshot_t, error) {
+	roles, err := s.GuildRoles(DISCORD_SERVER_ID)
+	if err != nil {
+		return role_snapshot_t{}, fmt.Errorf("could not load the roles: %w", err)
+	}
+	err = load_member_cache(s) // don't trust the cache for a safety net
+	if err != nil {
+		return role_snapshot_t{}, fmt.Errorf("could not load the members: %w", err)
+	}
+
+	snapshot := role_snapshot_t{
+		Id:            time.Now().UTC().Format("20060102-150405"),
+		Created_by:    authorID,
+		Created_at:    time.Now().UTC(),
+		Reason:        reason,
+		Members:       make(map[string][]string),
+		Member_names:  make(map[string]string),
+		Restored_role: make(map[string]string),
+	}
+	for _, id := range list_snapshot_ids() {
+		if id == snapshot.Id { // two snapshots in the same second
+			snapshot.Id += "b"
+		}
+	}
+	for _, r := range roles {
+		snapshot.Roles = append(snapshot.Roles, *r)
+	}
+	for _, member := range memberCache.all() {
+		snapshot.Members[member.User.ID] = append([]string(nil), member.Roles...)
+		snapshot.Member_names[member.User.ID] = member.User.String()
+	}
+
+	err = store_data(snapshot, snapshot_file(snapshot.Id))
+	if err != nil {
+		return role_snapshot_t{}, err
+	}
+	prune_snapshots()
+	log_info("took a role snapshot", log_fields{"guild": DISCORD_SERVER_ID, "snapshot": snapshot.Id, "roles": len(snapshot.Roles), "members": len(snapshot.Members)})
+	return snapshot, nil
+}
+
+// Returns the ids of the stored snapshots, oldest first
+func list_snapshot_ids() []string {
+	files, err := filepath.Glob("./data/" + snapshot_file("*"))
+	checkError(err)
+	var ids []string
+	for _, f := range files {
+		ids = append(ids, strings.TrimPrefix(filepath.Base(f), snapshot_file("")))
+	}
+	sort.Strings(ids) // ids are timestamps
+	return ids
+}
+
+func load_role_snapshot(id string) (role_snapshot_t, error) {
+	var snapshot role_snapshot_t
+	exists := false
+	for _, stored := range list_snapshot_ids() { // never build a path from user input
+		exists = exists || stored == id
+	}
+	if !exists {
+		return snapshot, fmt.Errorf("no snapshot %s", id)
+	}
+	load_data(&snapshot, snapshot_file(id))
+	if snapshot.Id != id {
+		return snapshot, fmt.Errorf("snapshot %s could not be read", id)
+	}
+	if snapshot.Restored_role == nil {
+		snapshot.Restored_role = make(map[string]string)
+	}
+	return snapshot, nil
+}
+
+// Keep only the newest SNAPSHOT_RETENTION snapshots
+func prune_snapshots() {
+	ids := list_snapshot_ids()
+	for len(ids) > SNAPSHOT_RETENTION {
+		err := os.Remove("./data/" + snapshot_file(ids[0]))
+		checkError(err)
+		ids = ids[1:]
+	}
+}
+
+// Id of the live role that stands for a role of the snapshot
+func (snapshot role_snapshot_t) live_role_id(roleID string) string {
+	if id, ok := snapshot.Restored_role[roleID]; ok {
+		return id
+	}
+	return roleID
+}
+
+// Compare a snapshot with the live guild
+func diff_role_snapshot(s *discordgo.Session, snapshot role_snapshot_t) (snapshot_diff_t, error) {
+	var diff snapshot_diff_t
+	roles, err := s.GuildRoles(DISCORD_SERVER_ID)
+	if err != nil {
+		return diff, fmt.Errorf("could not load the roles: %w", err)
+	}
+	members, err := get_guild_members(s)
+	if err != nil {
+		return diff, fmt.Errorf("could not load the members: %w", err)
+	}
+
+	liveRoles := make(map[string]*discordgo.Role)
+	for _, r := range roles {
+		liveRoles[r.ID] = r
+	}
+	known := make(map[string]bool) // live role ids that were in the snapshot
+	for _, old := range snapshot.Roles {
+		live, ok := liveRoles[snapshot.live_role_id(old.ID)]
+		if !ok {
+			diff.Deleted_roles = append(diff.Deleted_roles, old)
+			continue
+		}
+		known[live.ID] = true
+		var changes []string
+		if live.Name != old.Name {
+			changes = append(changes, fmt.Sprintf("name %s → %s", old.Name, live.Name))
+		}
+		if live.Color != old.Color {
+			changes = append(changes, fmt.Sprintf("color #%06x → #%06x", old.Color, live.Color))
+		}
+		if live.Permissions != old.Permissions {
+			changes = append(changes, fmt.Sprintf("permissions %d → %d", old.Permissions, live.Permissions))
+		}
+		if live.Hoist != old.Hoist || live.Mentionable != old.Mentionable {
+			changes = append(changes, "display settings")
+		}
+		if len(changes) > 0 {
+			diff.Changed_roles = append(diff.Changed_roles, old.Name+": "+strings.Join(changes, ", "))
+		}
+	}
+	for _, r := range roles {
+		if !known[r.ID] {
+			diff.Created_roles = append(diff.Created_roles, r)
+		}
+	}
+
+	liveMembers := make(map[string]*discordgo.Member)
+	for _, member := range members {
+		liveMembers[member.User.ID] = member
+	}
+	for discordId, oldRoles := range snapshot.Members {
+		member, ok := liveMembers[discordId]
+		if !ok {
+			diff.Left = append(diff.Left, discordId)
+			continue
+		}
+		had := make(map[string]bool)
+		for _, roleID := range oldRoles {
+			had[snapshot.live_role_id(roleID)] = true
+		}
+		has := make(map[string]bool)
+		for _, roleID := range member.Roles {
+			has[roleID] = true
+		}
+		d := member_role_diff_t{DiscordId: discordId, Name: snapshot.Member_names[discordId]}
+		for _, roleID := range oldRoles {
+			if !has[snapshot.live_role_id(roleID)] {
+				d.Removed = append(d.Removed, roleID)
+			}
+		}
+		for _, roleID := range member.Roles {
+			if !had[roleID] {
+				d.Added = append(d.Added, roleID)
+			}
+		}
+		if len(d.Added) > 0 || len(d.Removed) > 0 {
+			diff.Members = append(diff.Members, d)
+		}
+	}
+	sort.Slice(diff.Members, func(i, j int) bool {
+		return strings.ToLower(diff.Members[i].Name) < strings.ToLower(diff.Members[j].Name)
+	})
+	sort.Strings(diff.Left)
+	return diff, nil
+}
+
+// Name of a role of the snapshot or of the live guild
+func snapshot_role_name(snapshot role_snapshot_t, roles []*discordgo.Role, roleID string) string {
+	for _, r := range roles {
+		if r.ID == roleID {
+			return r.Name
+		}
+	}
+	for _, r := range snapshot.Roles {
+		if r.ID == roleID {
+			return r.Name
+		}
+	}
+	return roleID
+}
+
+// Full text of a diff, for the attachment
+func render_snapshot_diff(s *discordgo.Session, snapshot role_snapshot_t, diff snapshot_diff_t) string {
+	roles, err := s.GuildRoles(DISCORD_SERVER_ID)
+	checkError(err)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Snapshot %s (%s) compared with the server on %s\n\n", snapshot.Id, snapshot.Reason, time.Now().UTC().Format(time.RFC1123))
+	for _, r := range diff.Deleted_roles {
+		fmt.Fprintf(&b, "role deleted: %s (%s)\n", r.Name, r.ID)
+	}
+	for _, r := range diff.Created_roles {
+		fmt.Fprintf(&b, "role created: %s (%s)\n", r.Name, r.ID)
+	}
+	for _, line := range diff.Changed_roles {
+		fmt.Fprintf(&b, "role changed: %s\n", line)
+	}
+	b.WriteString("\n")
+	for _, d := range diff.Members {
+		var changes []string
+		for _, roleID := range d.Added {
+			changes = append(changes, "+"+snapshot_role_name(snapshot, roles, roleID))
+		}
+		for _, roleID := range d.Removed {
+			changes = append(changes, "-"+snapshot_role_name(snapshot, roles, roleID))
+		}
+		fmt.Fprintf(&b, "%s (%s): %s\n", d.Name, d.DiscordId, strings.Join(changes, " "))
+	}
+	for _, discordId := range diff.Left {
+		fmt.Fprintf(&b, "%s (%s) left the server\n", snapshot.Member_names[discordId], discordId)
+	}
+	return b.String()
+}
+
+// Recreate the roles deleted since the snapshot and put back the roles of every member that is still on the server
+// A snapshot of the current state is taken first, so the restore itself can be undone
+// Stops when ctx is cancelled, the members that weren't restored yet are reported as skipped
+func restore_role_snapshot(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, snapshot role_snapshot_t) error {
+	before, err := create_role_snapshot(s, m.Author.ID, "before restoring "+snapshot.Id)
+	if err != nil {
+		return fmt.Errorf("could not take a snapshot before restoring: %w", err)
+	}
+	diff, err := diff_role_snapshot(s, snapshot)
+	if err != nil {
+		return err
+	}
+
+	// 1. Recreate the deleted roles, roles of integrations and @everyone can't be
+	var recreated []*discordgo.Role
+	var failedRoles []string
+	for _, old := range diff.Deleted_roles {
+		if ctx.Err() != nil {
+			break
+		}
+		if old.Managed || old.ID == DISCORD_SERVER_ID {
+			continue
+		}
+		role, err := s.GuildRoleCreate(DISCORD_SERVER_ID)
+		if err == nil {
+			role, err = s.GuildRoleEdit(DISCORD_SERVER_ID, role.ID, old.Name, old.Color, old.Hoist, old.Permissions, old.Mentionable)
+		}
+		append_audit_log(audit_entry_t{
+			Actor:     m.Author.ID,
+			Command:   "/snapshot",
+			Arguments: "restore " + snapshot.Id,
+			Action:    "role_recreate",
+			Target:    fmt.Sprintf("%s (%s)", old.Name, old.ID),
+			After:     role_id_or_empty(role),
+			Result:    audit_result(err),
+		})
+		if err != nil {
+			log_error("could not recreate role", err, log_fields{"command": "/snapshot", "guild": DISCORD_SERVER_ID, "role": old.ID})
+			failedRoles = append(failedRoles, old.Name)
+			continue
+		}
+		snapshot.Restored_role[old.ID] = role.ID
+		remap_role_references(old.ID, role.ID)
+		role.Position = old.Position
+		recreated = append(recreated, role)
+	}
+	store_data(snapshot, snapshot_file(snapshot.Id))
+	if len(recreated) > 0 { // best effort, the bot can't move roles above its own
+		_, err = s.GuildRoleReorder(DISCORD_SERVER_ID, recreated)
+		checkError(err)
+	}
+
+	// 2. Put back the roles of every member, except roles of integrations
+	managed := make(map[string]bool)
+	for _, r := range snapshot.Roles {
+		managed[r.ID] = r.Managed
+	}
+	for _, r := range diff.Created_roles {
+		managed[r.ID] = r.Managed
+	}
+	var jobs []role_job_t
+	for _, d := range diff.Members {
+		desired := make(map[string]bool)
+		for _, roleID := range d.Added {
+			if !managed[roleID] {
+				desired[roleID] = false
+			}
+		}
+		for _, roleID := range d.Removed {
+			if _, recreatable := snapshot.Restored_role[roleID]; !recreatable && !role_in_snapshot_exists(diff, roleID) {
+				continue // deleted and couldn't be recreated
+			}
+			if !managed[roleID] {
+				desired[snapshot.live_role_id(roleID)] = true
+			}
+		}
+		if len(desired) == 0 {
+			continue
+		}
+		discordId := d.DiscordId
+		jobs = append(jobs, role_job_t{
+			Name:      d.Name,
+			DiscordId: discordId,
+			Run:       func() ([]string, error) { return apply_member_roles(s, discordId, desired) },
+		})
+	}
+	reports := run_role_jobs(ctx, s, m.ChannelID, m.Author.ID, "/snapshot restore", jobs)
+
+	summary := fmt.Sprintf("> Restored snapshot %s, recreated %d roles. To undo this, restore snapshot %s\n", snapshot.Id, len(recreated), before.Id)
+	if len(failedRoles) > 0 {
+		summary += "> Couldn't recreate " + strings.Join(failedRoles, ", ") + "\n"
+	}
+	if len(diff.Left) > 0 {
+		summary += fmt.Sprintf("> %d members of the snapshot left the server\n", len(diff.Left))
+	}
+	send_role_report(s, m.ChannelID, "/snapshot restore", summary, reports)
+	if len(failedRoles) > 0 || count_reports(reports)["failed"] > 0 {
+		return fmt.Errorf("%d roles and %d members could not be restored", len(failedRoles), count_reports(reports)["failed"])
+	}
+	return nil
+}
+
+// Show what restoring the snapshot would change and ask before restoring it
+// The conversation holds op until it ends, or hands it over to the approval of a second admin
+func start_restore_conversation(s *discordgo.Session, m *discordgo.MessageCreate, op *operation_t, snapshot role_snapshot_t) error {
+	diff, err := diff_role_snapshot(s, snapshot)
+	if err != nil {
+		return err
+	}
+	pending := false
+	c := new_conversation("/snapshot restore", m.Author.ID, m.ChannelID, conversation_step_t{
+		Name: "confirm",
+		Kind: STEP_CONFIRM,
+		Prompt: func() string {
+			return FIX_MSG_START + fmt.Sprintf("Restore the roles of %d members and recreate %d roles from snapshot %s?", len(diff.Members), len(diff.Deleted_roles), snapshot.Id) + FIX_MSG_END
+		},
+		Answer: func(string) (string, error) {
+			var err error
+			summary := fmt.Sprintf("restore the roles of %d members from snapshot %s", len(diff.Members), snapshot.Id)
+			pending, err = request_approval(s, op, summary, func() {
+				err := restore_role_snapshot(op.ctx, s, m, snapshot)
+				record_command("/snapshot", command_outcome(err))
+				if err != nil {
+					log_error("/snapshot failed", err, command_fields(m))
+					_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /snapshot restore ERROR: "+err.Error()+DIFF_MSG_END)
+					checkError(err)
+				}
+			})
+			return "", err
+		},
+	})
+	c.Ctx = op.ctx
+	c.OnEnd = func(string) {
+		if !pending {
+			op.release()
+		}
+	}
+	start_conversation(s, c)
+	return nil
+}
+
+// Whether a role the snapshot knows still exists (it wasn't deleted since)
+func role_in_snapshot_exists(diff snapshot_diff_t, roleID string) bool {
+	for _, r := range diff.Deleted_roles {
+		if r.ID == roleID {
+			return false
+		}
+	}
+	return true
+}
+
+func role_id_or_empty(role *discordgo.Role) string {
+	if role == nil {
+		return ""
+	}
+	return role.ID
+}
+
+// A recreated role replaces the deleted one in the team registry and in the batches
+func remap_role_references(oldID string, newID string) {
+	if team, ok := unregister_team_role(oldID); ok {
+		team.Role_id = newID
+		register_team(team)
+	}
+	roleBatchMutex.Lock()
+	defer roleBatchMutex.Unlock()
+	for name, batch := range mapRoleBatches {
+		for i, t := range batch.Teams {
+			if t.Discord_id == oldID {
+				batch.Teams[i].Discord_id = newID
+			}
+		}
+		mapRoleBatches[name] = batch
+	}
+	store_data(mapRoleBatches, "mapRoleBatches")
+}
+
+const SNAPSHOT_COMMAND_USAGE string = `/snapshot create [reason]
+/snapshot list
+/snapshot diff <id>
+/snapshot restore <id>`
+
+// /snapshot create|list|diff|restore
+func snapshot_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	args := split_arguments(strings.TrimPrefix(m.Content, "/snapshot"))
+	if len(args) == 0 {
+		_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+SNAPSHOT_COMMAND_USAGE+FIX_MSG_END)
+		checkError(err)
+		return
+	}
+
+	var err error
+	switch {
+	case args[0] == "create":
+		var snapshot role_snapshot_t
+		snapshot, err = create_role_snapshot(s, m.Author.ID, strings.Join(args[1:], " "))
+		if err == nil {
+			_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+fmt.Sprintf("+ Snapshot %s: %d roles, %d members", snapshot.Id, len(snapshot.Roles), len(snapshot.Members))+DIFF_MSG_END)
+			checkError(err)
+		}
+	case args[0] == "list":
+		message := "**Role snapshots**\n"
+		for _, id := range list_snapshot_ids() {
+			snapshot, err := load_role_snapshot(id)
+			if err != nil {
+				continue
+			}
+			createdBy := snapshot.Created_by
+			if createdBy != "starbot" {
+				createdBy = "<@" + createdBy + ">"
+			}
+			message += fmt.Sprintf("`%s` by %s, %d members %s\n", snapshot.Id, createdBy, len(snapshot.Members), snapshot.Reason)
+		}
+		send_quiet_message(s, m.ChannelID, message)
+	case args[0] == "diff" && len(args) == 2:
+		var snapshot role_snapshot_t
+		var diff snapshot_diff_t
+		snapshot, err = load_role_snapshot(args[1])
+		if err == nil {
+			diff, err = diff_role_snapshot(s, snapshot)
+		}
+		if err == nil {
+			message := DIFF_MSG_START + fmt.Sprintf("+ Since snapshot %s: %d roles deleted, %d created, %d changed\n+ %d members have different roles, %d left the server", snapshot.Id, len(diff.Deleted_roles), len(diff.Created_roles), len(diff.Changed_roles), len(diff.Members), len(diff.Left)) + DIFF_MSG_END
+			_, err = s.ChannelFileSendWithMessage(m.ChannelID, message, "snapshot-"+snapshot.Id+"-diff.txt", bytes.NewBufferString(render_snapshot_diff(s, snapshot, diff)))
+			checkError(err)
+		}
+	case args[0] == "restore" && len(args) == 2:
+		var snapshot role_snapshot_t
+		snapshot, err = load_role_snapshot(args[1])
+		if err != nil {
+			break
+		}
+		var op *operation_t
+		op, err = start_operation(m.Author.ID, "/snapshot restore", m.ChannelID, PROMPT_LOCK_TTL)
+		if err != nil {
+			break
+		}
+		err = start_restore_conversation(s, m, op, snapshot)
+		if err != nil {
+			op.release()
+			break
+		}
+		return // the conversation reports the outcome
+	default:
+		err = fmt.Errorf("usage:\n%s", SNAPSHOT_COMMAND_USAGE)
+	}
+
+	record_command("/snapshot", command_outcome(err))
+	if err != nil {
+		log_error("/snapshot failed", err, command_fields(m))
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /snapshot ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Team roles from before the registry existed, only used to seed an empty registry
+var LEGACY_TEAM_ROLE_IDS = map[string]string{
+	"Team 1": "952362058282836079",
+	"Team 2": "952363361360810015",
+	"Team 3": "952363465299853373",
+	"Team 4": "952363498233536533",
+	"Team 5": "952363548166750259",
+	"Team 6": "952363607616794624",
+}
+
+// A team of the current or a past season
+type registered_team_t struct {
+	Name             string
+	Aliases          []string // previous names, so WebApp/sheet names keep resolving after a rename
+	Role_id          string
+	Color            int
+	Captain_id       string
+	Coach_id         string
+	Category_id      string
+	Text_channel_id  string
+	Voice_channel_id string
+	Season           int
+	Archived         bool
+	Created_by       string
+	Created_at       time.Time
+}
+
+var mapTeamRegistry = map[string]registered_team_t{} // [Role_id]team
+var teamRegistryMutex sync.RWMutex                   // commands, role workers and role events use the registry at the same time
+
+// Seed the registry with the teams that used to be hardcoded
+func seed_team_registry() {
+	teamRegistryMutex.Lock()
+	defer teamRegistryMutex.Unlock()
+	if len(mapTeamRegistry) > 0 {
+		return
+	}
+	for name, roleID := range LEGACY_TEAM_ROLE_IDS {
+		mapTeamRegistry[roleID] = registered_team_t{
+			Name:       name,
+			Role_id:    roleID,
+			Color:      NEON_GREEN,
+			Season:     current_season(),
+			Created_by: "starbot",
+			Created_at: time.Now().UTC(),
+		}
+	}
+	store_data(mapTeamRegistry, "mapTeamRegistry")
+}
+
+// The current CPL edition, taken from the roster
+func current_season() int {
+	season := 0
+	for _, p := range all_web_players() {
+		if p.Cpl_edition > season {
+			season = p.Cpl_edition
+		}
+	}
+	return season
+}
+
+// Returns the active team with the given name or previous name (case-insensitive)
+func resolve_team(name string) (registered_team_t, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return registered_team_t{}, false
+	}
+	teamRegistryMutex.RLock()
+	defer teamRegistryMutex.RUnlock()
+	for _, t := range mapTeamRegistry {
+		if t.Archived {
+			continue
+		}
+		if strings.EqualFold(t.Name, name) {
+			return t, true
+		}
+		for _, alias := range t.Aliases {
+			if strings.EqualFold(alias, name) {
+				return t, true
+			}
+		}
+	}
+	return registered_team_t{}, false
+}
+
+// Returns the active teams sorted by name
+func active_teams() []registered_team_t {
+	var teams []registered_team_t
+	teamRegistryMutex.RLock()
+	for _, t := range mapTeamRegistry {
+		if !t.Archived {
+			teams = append(teams, t)
+		}
+	}
+	teamRegistryMutex.RUnlock()
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams
+}
+
+// Returns the registered team of a role, archived or not
+func get_registered_team(roleID string) (registered_team_t, bool) {
+	teamRegistryMutex.RLock()
+	defer teamRegistryMutex.RUnlock()
+	team, ok := mapTeamRegistry[roleID]
+	return team, ok
+}
+
+func register_team(t registered_team_t) {
+	teamRegistryMutex.Lock()
+	defer teamRegistryMutex.Unlock()
+	mapTeamRegistry[t.Role_id] = t
+	store_data(mapTeamRegistry, "mapTeamRegistry")
+}
+
+// Remove teams whose role was deleted, returns the removed team
+func unregister_team_role(roleID string) (registered_team_t, bool) {
+	teamRegistryMutex.Lock()
+	defer teamRegistryMutex.Unlock()
+	team, ok := mapTeamRegistry[roleID]
+	if ok {
+		delete(mapTeamRegistry, roleID)
+		store_data(mapTeamRegistry, "mapTeamRegistry")
+	}
+	return team, ok
+}
+
+// Is called by AddHandler every time a role is deleted, team roles deleted by hand leave the registry
+func on_role_delete(s *discordgo.Session, e *discordgo.GuildRoleDelete) {
+	if e.GuildID != DISCORD_SERVER_ID {
+		return
+	}
+	if team, ok := unregister_team_role(e.RoleID); ok {
+		send_staff_message(s, fmt.Sprintf("> The role of team %s was deleted, the team was removed from the registry", team.Name))
+	}
+}
+
+// Change the name and color of a team role, everything else about the role stays as it is
+// A role that no longer exists is removed from the registry
+func edit_team_role(s *discordgo.Session, roleID string, name string, color int) error {
+	var role *discordgo.Role
+	roles, err := s.GuildRoles(DISCORD_SERVER_ID)
+	if err != nil {
+		return err
+	}
+	for _, r := range roles {
+		if r.ID == roleID {
+			role = r
+		}
+	}
+	if role == nil {
+		unregister_team_role(roleID)
+		return fmt.Errorf("the role of %s was deleted, the team was removed", name)
+	}
+	_, err = s.GuildRoleEdit(DISCORD_SERVER_ID, roleID, name, color, role.Hoist, role.Permissions, role.Mentionable)
+	if is_not_found(err) {
+		unregister_team_role(roleID)
+		return fmt.Errorf("the role of %s was deleted, the team was removed", name)
+	}
+	return err
+}
+
+// Create the discord role of a new team and add it to the registry
+func create_team(s *discordgo.Session, name string, color int, authorID string) (registered_team_t, error) {
+	if _, exists := resolve_team(name); exists {
+		return registered_team_t{}, fmt.Errorf("team %s already exists", name)
+	}
+	role, err := s.GuildRoleCreate(DISCORD_SERVER_ID)
+	if err != nil {
+		return registered_team_t{}, err
+	}
+	role, err = s.GuildRoleEdit(DISCORD_SERVER_ID, role.ID, name, color, role.Hoist, role.Permissions, role.Mentionable)
+	if err != nil {
+		checkError(s.GuildRoleDelete(DISCORD_SERVER_ID, role.ID)) // don't leave an unnamed role behind
+		return registered_team_t{}, err
+	}
+	team := registered_team_t{
+		Name:       name,
+		Role_id:    role.ID,
+		Color:      color,
+		Season:     current_season(),
+		Created_by: authorID,
+		Created_at: time.Now().UTC(),
+	}
+	register_team(team)
+	return team, nil
+}
+
+// Parse "#ff00aa", "ff00aa" or a decimal color
+func parse_color(arg string) (int, error) {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "#") || strings.HasPrefix(arg, "0x") {
+		c, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimPrefix(arg, "#"), "0x"), 16, 32)
+		return int(c), err
+	}
+	if c, err := strconv.ParseInt(arg, 10, 32); err == nil {
+		return int(c), nil
+	}
+	c, err := strconv.ParseInt(arg, 16, 32)
+	return int(c), err
+}
+
+// Split command arguments on spaces, "quoted arguments" may contain spaces
+func split_arguments(input string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+const TEAM_COMMAND_USAGE string = `/team list
+/team create "<name>" [#color]
+/team provision "<name>"
+/team rename "<name>" "<new name>"
+/team color "<name>" <#color>
+/team captain "<name>" @member
+/team coach "<name>" @member
+/team archive "<name>"`
+
+// /team create|provision|rename|color|captain|coach|archive|list
+func team_command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	args := split_arguments(strings.TrimPrefix(m.Content, "/team"))
+	if len(args) == 0 {
+		_, err := s.ChannelMessageSend(m.ChannelID, FIX_MSG_START+TEAM_COMMAND_USAGE+FIX_MSG_END)
+		checkError(err)
+		return
+	}
+
+	var reply string
+	var err error
+	switch {
+	case args[0] == "list":
+		reply = team_list_message()
+	case args[0] == "create" && (len(args) == 2 || len(args) == 3):
+		color := NEON_GREEN
+		if len(args) == 3 {
+			color, err = parse_color(args[2])
+		}
+		if err == nil {
+			err = check_staff_role()
+		}
+		if err == nil {
+			var team registered_team_t
+			team, err = create_team(s, args[1], color, m.Author.ID)
+			if err != nil {
+				break
+			}
+			err = provision_team(s, &team)
+			batch := new_role_batch("/team create", m.Author.ID, "")
+			batch.Teams = append(batch.Teams, batch_entry(team, false))
+			record_batch(batch)
+			reply = fmt.Sprintf("+ Created team %s (season %d) with its channels, batch %s", team.Name, team.Season, batch.Name)
+		}
+	case args[0] == "provision" && len(args) == 2:
+		team, ok := resolve_team(args[1])
+		if !ok {
+			err = fmt.Errorf("no active team named %s", args[1])
+			break
+		}
+		if team.Category_id != "" {
+			err = fmt.Errorf("%s already has channels", team.Name)
+			break
+		}
+		if err = check_staff_role(); err != nil {
+			break
+		}
+		err = provision_team(s, &team)
+		if team.Category_id != "" { // roll back whatever was created, even after an error
+			batch := new_role_batch("/team provision", m.Author.ID, "")
+			batch.Teams = append(batch.Teams, batch_entry(team, true))
+			record_batch(batch)
+			reply = fmt.Sprintf("+ Created the channels of %s, batch %s", team.Name, batch.Name)
+		}
+	case args[0] == "rename" && len(args) == 3:
+		err = rename_team(s, args[1], args[2])
+		reply = fmt.Sprintf("+ Renamed %s to %s", args[1], args[2])
+	case args[0] == "color" && len(args) == 3:
+		var color int
+		color, err = parse_color(args[2])
+		if err == nil {
+			err = edit_team(args[1], func(t *registered_team_t) error {
+				t.Color = color
+				return edit_team_role(s, t.Role_id, t.Name, color)
+			})
+		}
+		reply = fmt.Sprintf("+ Changed the color of %s to #%06x", args[1], color)
+	case (args[0] == "captain" || args[0] == "coach") && len(args) == 3:
+		memberID, ok := parse_member_argument(args[2])
+		if !ok {
+			err = fmt.Errorf("%s is not a member mention or id", args[2])
+			break
+		}
+		err = edit_team(args[1], func(t *registered_team_t) error {
+			if args[0] == "captain" {
+				t.Captain_id = memberID
+			} else {
+				t.Coach_id = memberID
+			}
+			return nil
+		})
+		reply = fmt.Sprintf("+ Set the %s of %s", args[0], args[1])
+	case args[0] == "archive" && len(args) == 2:
+		err = archive_team(s, args[1])
+		reply = fmt.Sprintf("+ Archived %s", args[1])
+	default:
+		err = fmt.Errorf("usage:\n%s", TEAM_COMMAND_USAGE)
+	}
+
+	record_command("/team", command_outcome(err))
+	if len(args) > 1 {
+		append_audit_log(audit_entry_t{
+			Actor:     m.Author.ID,
+			Command:   "/team",
+			Arguments: strings.Join(args, " "),
+			Action:    "team_" + args[0],
+			Target:    args[1],
+			Result:    audit_result(err),
+		})
+	}
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /team ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return
+	}
+	_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+reply+DIFF_MSG_END)
+	checkError(err)
+}
+
+// Apply a change to a registered team and persist it
+func edit_team(name string, change func(t *registered_team_t) error) error {
+	team, ok := resolve_team(name)
+	if !ok {
+		return fmt.Errorf("no active team named %s", name)
+	}
+	err := change(&team)
+	if err != nil {
+		return err
+	}
+	register_team(team)
+	return nil
+}
+
+// Rename a team and its role, the old name is kept as an alias
+// If a channel can't be renamed, the role and the channels renamed so far get their old name back
+func rename_team(s *discordgo.Session, name string, newName string) error {
+	if other, exists := resolve_team(newName); exists && !strings.EqualFold(other.Name, name) {
+		return fmt.Errorf("team %s already exists", newName)
+	}
+	return edit_team(name, func(t *registered_team_t) error {
+		err := edit_team_role(s, t.Role_id, newName, t.Color)
+		if err != nil {
+			return err
+		}
+		renamed := *t
+		renamed.Name = newName
+		err = rename_team_channels(s, renamed)
+		if err != nil {
+			checkError(edit_team_role(s, t.Role_id, t.Name, t.Color))
+			checkError(rename_team_channels(s, *t))
+			return err
+		}
+		t.Aliases = append(t.Aliases, t.Name)
+		t.Name = newName
+		return nil
+	})
+}
+
+// Archive a team at the end of the season, sync commands will no longer assign its role
+// Its channels become read-only and move to the archive category of the season
+func archive_team(s *discordgo.Session, name string) error {
+	return edit_team(name, func(t *registered_team_t) error {
+		err := archive_team_channels(s, t)
+		if err != nil {
+			return err
+		}
+		t.Archived = true
+		return nil
+	})
+}
+
+// Overview of the registered teams
+func team_list_message() string {
+	teams := active_teams()
+	if len(teams) == 0 {
+		return "No active teams"
+	}
+	message := fmt.Sprintf("%d active teams:\n", len(teams))
+	for _, t := range teams {
+		message += fmt.Sprintf("%s (season %d, #%06x)", t.Name, t.Season, t.Color)
+		if len(t.Aliases) > 0 {
+			message += " aka " + strings.Join(t.Aliases, ", ")
+		}
+		message += "\n"
+	}
+	return message
+}
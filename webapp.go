@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	//third party dependencies:
+	"github.com/bwmarrin/discordgo"
+)
+
+// Human readable names of the race keys used by the WebApp
+var WEB_RACE_NAMES = map[int]string{
+	6:  "Protoss",
+	7:  "Zerg",
+	8:  "Terran",
+	9:  "Declared weekly",
+	10: "Race picker",
+}
+
+// Tier values the WebApp is allowed to export (999 means the player has no tier)
+var VALID_WEB_TIERS = map[int]bool{
+	0:   true,
+	1:   true,
+	2:   true,
+	3:   true,
+	999: true,
+}
+
+// HTTP cache validators of the last players.json export downloaded from the WebApp
+type webappCache_t struct {
+	ETag         string
+	LastModified string
+	FetchedAt    time.Time
+}
+
+var webappCache webappCache_t // persisted so we don't redownload an unchanged export after a restart
+
+// Refresh mapWebUserIdToPlayer from the WebApp export and post a change summary to staff if it changed
+// Falls back to the manually copied ./data/players.json if WEBAPP_PLAYERS_URL is not set
+func refresh_web_players(s *discordgo.Session) error {
+	var players []web_player_t
+	if WEBAPP_PLAYERS_URL == "" {
+		data, err := ioutil.ReadFile("./data/players.json")
+		if err != nil {
+			return err
+		}
+		players, err = parse_web_players(data)
+		if err != nil {
+			return err
+		}
+	} else {
+		fetched, changed, err := fetch_web_players()
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil // export is unchanged, keep using what we have
+		}
+		players = fetched
+	}
+
+	summary := summarize_web_player_changes(copy_web_players(), players)
+	load_web_players(players)
+	if len(summary) > 0 {
+		send_staff_message(s, "**players.json changed:**\n"+summary)
+	}
+	return nil
+}
+
+// Download players.json from the WebApp
+// Returns changed=false if the export did not change since the last download
+func fetch_web_players() (players []web_player_t, changed bool, err error) {
+	req, err := http.NewRequest("GET", WEBAPP_PLAYERS_URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	token, err := ioutil.ReadFile("./keys/webapp_token")
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if webappCache.ETag != "" {
+		req.Header.Set("If-None-Match", webappCache.ETag)
+	}
+	if webappCache.LastModified != "" {
+		req.Header.Set("If-Modified-Since", webappCache.LastModified)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("WebApp export returned %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	players, err = parse_web_players(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// keep a copy on disk so the last good export survives WebApp outages
+	err = ioutil.WriteFile("./data/players.json", data, 0600)
+	checkError(err)
+
+	webappCache.ETag = resp.Header.Get("ETag")
+	webappCache.LastModified = resp.Header.Get("Last-Modified")
+	webappCache.FetchedAt = time.Now()
+	store_data(webappCache, "webappCache")
+	return players, true, nil
+}
+
+// Unmarshal and validate a players.json export
+func parse_web_players(data []byte) ([]web_player_t, error) {
+	var players []web_player_t
+	err := json.Unmarshal(data, &players)
+	if err != nil {
+		return nil, fmt.Errorf("players.json does not match web_player_t: %v", err)
+	}
+	err = validate_web_players(players)
+	if err != nil {
+		return nil, err
+	}
+	return players, nil
+}
+
+// Returns an error describing the first entry that doesn't hold usable player data
+func validate_web_players(players []web_player_t) error {
+	if len(players) == 0 {
+		return fmt.Errorf("players.json contains no players")
+	}
+	seenIds := make(map[int]bool)
+	for i, p := range players {
+		switch {
+		case p.WebUserId <= 0:
+			return fmt.Errorf("entry %d: missing or invalid id", i)
+		case seenIds[p.WebUserId]:
+			return fmt.Errorf("entry %d: duplicate id %d", i, p.WebUserId)
+		case strings.TrimSpace(p.WebName) == "":
+			return fmt.Errorf("entry %d (id %d): missing Name", i, p.WebUserId)
+		case !VALID_WEB_TIERS[p.Tier]:
+			return fmt.Errorf("entry %d (%s): invalid Tier %d", i, p.WebName, p.Tier)
+		case p.Race != 0 && WEB_RACE_NAMES[p.Race] == "":
+			return fmt.Errorf("entry %d (%s): invalid Race %d", i, p.WebName, p.Race)
+		}
+		seenIds[p.WebUserId] = true
+	}
+	return nil
+}
+
+// Replace the roster with the given players, keeping the discord ids we already resolved
+func load_web_players(players []web_player_t) {
+	rosterMutex.Lock()
+	defer rosterMutex.Unlock()
+	oldPlayers := mapWebUserIdToPlayer
+	mapWebUserIdToPlayer = make(map[int]web_player_t)
+	mapWebUserNameToWebUserId = make(map[string]int)
+	for _, p := range players {
+		if old, ok := oldPlayers[p.WebUserId]; ok {
+			p = keep_local_player_fields(p, old)
+		}
+		mapWebUserIdToPlayer[p.WebUserId] = p
+		mapWebUserNameToWebUserId[p.WebName] = p.WebUserId
+	}
+	store_roster_locked()
+}
+
+// Copy what only the bot knows about a player (discord id, presence, manual links) from the old record into a fresh WebApp record
+func keep_local_player_fields(p web_player_t, old web_player_t) web_player_t {
+	if p.Discord_id == "" {
+		p.Discord_id = old.Discord_id
+	}
+	if link, ok := mapManualLinks[p.WebUserId]; ok { // bindings made by an admin win
+		p.Discord_id = link.DiscordId
+	}
+	if p.Discord_id == old.Discord_id {
+		p.Left_server = old.Left_server
+		p.Left_at = old.Left_at
+	}
+	return p
+}
+
+// Returns a human readable summary of new players, team moves, tier changes and race changes
+// Returns an empty string if nothing relevant changed, or if there was no roster yet (everybody would be new)
+func summarize_web_player_changes(old map[int]web_player_t, players []web_player_t) string {
+	if len(old) == 0 {
+		return ""
+	}
+	var added, removed, teams, tiers, races []string
+	seen := make(map[int]bool)
+	for _, p := range players {
+		seen[p.WebUserId] = true
+		before, ok := old[p.WebUserId]
+		if !ok {
+			added = append(added, fmt.Sprintf("+ %s (%s, %s, %s)", p.WebName, team_or_none(p.Team), tier_name(p.Tier), race_name(p.Race)))
+			continue
+		}
+		if before.Team != p.Team {
+			teams = append(teams, fmt.Sprintf("%s: %s -> %s", p.WebName, team_or_none(before.Team), team_or_none(p.Team)))
+		}
+		if before.Tier != p.Tier {
+			tiers = append(tiers, fmt.Sprintf("%s: %s -> %s", p.WebName, tier_name(before.Tier), tier_name(p.Tier)))
+		}
+		if before.Race != p.Race {
+			races = append(races, fmt.Sprintf("%s: %s -> %s", p.WebName, race_name(before.Race), race_name(p.Race)))
+		}
+	}
+	for id, p := range old {
+		if !seen[id] {
+			removed = append(removed, "- "+p.WebName)
+		}
+	}
+
+	var summary string
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"New players", added},
+		{"Removed players", removed},
+		{"Team moves", teams},
+		{"Tier changes", tiers},
+		{"Race changes", races},
+	}
+	for _, section := range sections {
+		if len(section.lines) == 0 {
+			continue
+		}
+		sort.Strings(section.lines)
+		summary += fmt.Sprintf("**%s (%d):**\n", section.title, len(section.lines))
+		summary += strings.Join(section.lines, "\n") + "\n"
+	}
+	return summary
+}
+
+func team_or_none(team string) string {
+	if team == "" {
+		return "no team"
+	}
+	return team
+}
+
+func tier_name(tier int) string {
+	if tier == 999 {
+		return "no tier"
+	}
+	return fmt.Sprintf("Tier %d", tier)
+}
+
+func race_name(race int) string {
+	if name, ok := WEB_RACE_NAMES[race]; ok {
+		return name
+	}
+	return "no race"
+}
+
+// Validate a players.json that was attached to the message, show what it would change and ask for confirmation
+// The conversation holds op until it ends, returns false if there is nothing to confirm
+func upload_web_players(s *discordgo.Session, m *discordgo.MessageCreate, op *operation_t) bool {
+	if len(m.Attachments) != 1 {
+		_, err := s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /uploadplayers ERROR: ATTACH EXACTLY ONE players.json"+DIFF_MSG_END)
+		checkError(err)
+		return false
+	}
+
+	var players []web_player_t
+	data, err := download_attachment(m.Attachments[0])
+	if err == nil {
+		players, err = parse_web_players(data)
+	}
+	if err != nil {
+		_, err = s.ChannelMessageSend(m.ChannelID, DIFF_MSG_START+"- /uploadplayers ERROR: "+err.Error()+DIFF_MSG_END)
+		checkError(err)
+		return false
+	}
+
+	summary := summarize_web_player_changes(copy_web_players(), players)
+	switch {
+	case count_web_players() == 0:
+		summary = "There is no roster yet, all players are new.\n"
+	case len(summary) == 0:
+		summary = "No team, tier or race changes.\n"
+	}
+	send_long_message(s, m.ChannelID, fmt.Sprintf("**Uploaded players.json (%d players):**\n", len(players))+summary)
+
+	confirmed := false
+	c := new_conversation("/uploadplayers", m.Author.ID, m.ChannelID, conversation_step_t{
+		Name: "confirm",
+		Kind: STEP_CONFIRM,
+		Prompt: func() string {
+			return FIX_MSG_START + fmt.Sprintf("Replace the roster with these %d players?", len(players)) + FIX_MSG_END
+		},
+		Answer: func(string) (string, error) {
+			confirmed = true
+			confirm_upload_web_players(s, m.ChannelID, m.Author.ID, players, data)
+			return "", nil
+		},
+	})
+	c.Ctx = op.ctx
+	c.OnEnd = func(string) {
+		if !confirmed {
+			record_command("/uploadplayers", "cancelled")
+		}
+		op.release()
+	}
+	start_conversation(s, c)
+	return true
+}
+
+// Replace the roster with the uploaded players.json once the admin confirmed it
+func confirm_upload_web_players(s *discordgo.Session, channelID string, authorID string, players []web_player_t, data []byte) {
+	load_web_players(players)
+	err := ioutil.WriteFile("./data/players.json", data, 0600)
+	checkError(err)
+	record_command("/uploadplayers", command_outcome(err))
+	append_audit_log(audit_entry_t{
+		Actor:   authorID,
+		Command: "/uploadplayers",
+		Action:  "roster_upload",
+		Target:  "./data/players.json",
+		After:   fmt.Sprintf("%d players", count_web_players()),
+		Result:  audit_result(err),
+	})
+	_, err = s.ChannelMessageSend(channelID, DIFF_MSG_START+fmt.Sprintf("+ /uploadplayers DONE: roster replaced with %d players", count_web_players())+DIFF_MSG_END)
+	checkError(err)
+}
+
+// Download a file that was attached to a discord message
+func download_attachment(a *discordgo.MessageAttachment) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(a.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s returned %s", a.Filename, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}